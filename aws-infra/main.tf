@@ -307,6 +307,36 @@ resource "aws_s3_bucket_public_access_block" "movies_app_bucket_public_access" {
 
 }
 
+// Browsers upload covers directly to the bucket with presigned urls
+resource "aws_s3_bucket_cors_configuration" "movies_app_bucket_cors" {
+  bucket = aws_s3_bucket.movies_app_bucket.id
+
+  cors_rule {
+    allowed_methods = ["PUT"]
+    allowed_origins = ["*"]
+    allowed_headers = ["Content-Type", "Content-Length"]
+    max_age_seconds = 3000
+  }
+}
+
+// Direct uploads that were never confirmed
+resource "aws_s3_bucket_lifecycle_configuration" "movies_app_bucket_lifecycle" {
+  bucket = aws_s3_bucket.movies_app_bucket.id
+
+  rule {
+    id     = "expire-unconfirmed-uploads"
+    status = "Enabled"
+
+    filter {
+      prefix = "uploads/"
+    }
+
+    expiration {
+      days = 1
+    }
+  }
+}
+
 resource "aws_s3_bucket_policy" "allow_get_images_policy" {
   bucket = aws_s3_bucket.movies_app_bucket.id
   policy = data.aws_iam_policy_document.allow_get_s3_images_policy.json
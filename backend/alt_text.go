@@ -0,0 +1,213 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/gin-gonic/gin"
+)
+
+const MAX_ALT_TEXT_LENGTH int = 250
+
+type coverAltText struct {
+	AltText     string `json:"altText"`
+	Description string `json:"description"`
+}
+
+// Handler for POST /api/movies/:movieId/cover/alt-text/generate
+func regenerateCoverAltText(c *gin.Context) {
+	slog.DebugContext(c.Request.Context(), "Inside regenerateCoverAltText func")
+
+	movieId := c.Param("movieId")
+	if movieId == "" {
+		respondError(c, invalidField("movieId", "cannot be empty"))
+		return
+	}
+
+	movie, err := GetMovieById_DB(c.Request.Context(), movieId)
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+
+	if movie.CoverKey == nil || *movie.CoverKey == "" {
+		respondError(c, newError(ErrConflict, "movie has no cover image"))
+		return
+	}
+
+	objectKey := *movie.CoverKey
+	image, contentType, err := getCoverImage(c.Request.Context(), objectKey)
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+
+	result, err := GenerateCoverAltText(c.Request.Context(), movie, image, imageFormat(contentType, objectKey), llmUser(c))
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+
+	if err := UpdateCoverAltText_DB(c.Request.Context(), movie.MovieId, movie.CoverKey, result.AltText, result.Description); err != nil {
+		respondError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, response(http.StatusOK, true, "Cover alt text generated", result))
+}
+
+// Handler for PUT /api/movies/:movieId/cover/alt-text, lets editors override the generated text
+func updateCoverAltText(c *gin.Context) {
+	slog.DebugContext(c.Request.Context(), "Inside updateCoverAltText func")
+
+	movieId := c.Param("movieId")
+	if movieId == "" {
+		respondError(c, invalidField("movieId", "cannot be empty"))
+		return
+	}
+
+	altText := strings.TrimSpace(c.PostForm("altText"))
+	description := strings.TrimSpace(c.PostForm("description"))
+
+	slog.DebugContext(c.Request.Context(), "FormData", "altText", altText, "description", description)
+
+	if altText == "" {
+		respondError(c, invalidField("altText", "cannot be empty"))
+		return
+	}
+
+	if utf8.RuneCountInString(altText) > MAX_ALT_TEXT_LENGTH {
+		respondError(c, invalidField("altText", fmt.Sprintf("cannot be longer than %d characters", MAX_ALT_TEXT_LENGTH)))
+		return
+	}
+
+	movie, err := GetMovieById_DB(c.Request.Context(), movieId)
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+
+	if err := UpdateCoverAltText_DB(c.Request.Context(), movie.MovieId, movie.CoverKey, altText, description); err != nil {
+		respondError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, response(http.StatusOK, true, "Cover alt text updated", nil))
+}
+
+// Generate the alt text for a just uploaded cover in the background so the upload
+// request doesn't wait for the model. It's only saved while the movie still has that
+// cover, a newer upload has its own job.
+func generateCoverAltTextAsync(ctx context.Context, movie Movie, cover coverUpload, userId string) {
+	runInBackground(ctx, "alt_text", func(ctx context.Context) {
+		result, err := GenerateCoverAltText(ctx, movie, cover.Image, cover.Format, userId)
+		if err != nil {
+			slog.ErrorContext(ctx, "Error generating alt text", "movieId", movie.MovieId, "error", err)
+			return
+		}
+
+		if err := UpdateCoverAltText_DB(ctx, movie.MovieId, &cover.Key, result.AltText, result.Description); err != nil {
+			slog.ErrorContext(ctx, "Error saving alt text", "movieId", movie.MovieId, "error", err)
+		}
+	})
+}
+
+// Send the cover image to the model and get back alt text and a longer visual description
+func GenerateCoverAltText(ctx context.Context, movie Movie, image []byte, format string, userId string) (coverAltText, error) {
+	slog.DebugContext(ctx, "Inside GenerateCoverAltText func")
+
+	if format == "" {
+		return coverAltText{}, newError(ErrConflict, "cover image format is not supported for alt text generation")
+	}
+
+	prompt := fmt.Sprintf(`This image is the cover of the movie described below.
+Respond with only a JSON object of the form {"altText": "", "description": ""} where:
+- altText is a concise alternative text for screen readers, at most %d characters, without starting with "Image of"
+- description is a 2-3 sentence visual description of the image
+
+%v`, MAX_ALT_TEXT_LENGTH, movieDataBlock(movie))
+
+	result, err := Generator.Generate(ctx, GenerationRequest{
+		System: "You write accessible image descriptions. Only respond with JSON. " + DATA_BLOCK_INSTRUCTION,
+		Messages: []ChatMessage{{
+			Role:    ROLE_USER,
+			Content: prompt,
+			Images:  []ImageInput{{Format: format, Bytes: image}},
+		}},
+		MaxTokens: 400,
+		Operation: LLM_OP_ALT_TEXT,
+		UserId:    userId,
+	})
+	if err != nil {
+		slog.ErrorContext(ctx, "Error generating alt text", "error", err)
+		return coverAltText{}, err
+	}
+
+	var altText coverAltText
+	start, end := strings.Index(result.Text, "{"), strings.LastIndex(result.Text, "}")
+	if start == -1 || end < start {
+		return altText, newError(ErrUpstream, "model did not return valid alt text")
+	}
+
+	if err := json.Unmarshal([]byte(result.Text[start:end+1]), &altText); err != nil || altText.AltText == "" {
+		slog.WarnContext(ctx, "Invalid alt text response", "text", result.Text, "error", err)
+		return altText, newError(ErrUpstream, "model did not return valid alt text")
+	}
+
+	altText.AltText = strings.TrimSpace(altText.AltText)
+	if runes := []rune(altText.AltText); len(runes) > MAX_ALT_TEXT_LENGTH {
+		altText.AltText = string(runes[:MAX_ALT_TEXT_LENGTH])
+	}
+	altText.Description = strings.TrimSpace(altText.Description)
+
+	return altText, nil
+}
+
+// Image format name the model accepts, from the content type or else the file extension
+func imageFormat(contentType string, filename string) string {
+	switch contentType {
+	case "image/jpeg":
+		return "jpeg"
+	case "image/png":
+		return "png"
+	case "image/gif":
+		return "gif"
+	case "image/webp":
+		return "webp"
+	}
+
+	switch strings.ToLower(filepath.Ext(filename)) {
+	case ".jpg", ".jpeg":
+		return "jpeg"
+	case ".png":
+		return "png"
+	case ".gif":
+		return "gif"
+	case ".webp":
+		return "webp"
+	}
+
+	return ""
+}
+
+// Update the cover alt text and description of a movie in DB, as long as coverKey is still
+// its cover. Text written for a cover that was replaced meanwhile is dropped.
+func UpdateCoverAltText_DB(ctx context.Context, movieId int, coverKey *string, altText string, description string) error {
+	slog.DebugContext(ctx, "Inside UpdateCoverAltText_DB func")
+
+	ctx, cancel := dbContext(ctx)
+	defer cancel()
+
+	_, err := db.ExecContext(ctx, "UPDATE movie_details SET coverAltText=?, coverDescription=? WHERE movieId=? AND coverKey <=> ?", altText, description, movieId, coverKey)
+	if err != nil {
+		return fmt.Errorf("UpdateCoverAltText_DB error: %v", err)
+	}
+
+	return nil
+}
@@ -2,12 +2,13 @@ package main
 
 import (
 	"context"
-	"log"
+	"log/slog"
 
-	"github.com/aws/aws-sdk-go-v2/config"
+	awsconfig "github.com/aws/aws-sdk-go-v2/config"
 	"github.com/aws/aws-sdk-go-v2/service/bedrockruntime"
 	"github.com/aws/aws-sdk-go-v2/service/s3"
 	"github.com/aws/aws-sdk-go-v2/service/secretsmanager"
+	"go.opentelemetry.io/contrib/instrumentation/github.com/aws/aws-sdk-go-v2/otelaws"
 )
 
 var (
@@ -17,13 +18,16 @@ var (
 )
 
 func InitAWSClients() {
-	log.Println("Initializing AWS SDK clients")
+	slog.Info("Initializing AWS SDK clients", "region", appConfig.AWS.Region)
 
-	cfg, err := config.LoadDefaultConfig(context.TODO(), config.WithRegion(AWS_REGION))
+	cfg, err := awsconfig.LoadDefaultConfig(context.Background(), awsconfig.WithRegion(appConfig.AWS.Region))
 	if err != nil {
-		log.Fatalf("Unable to load AWS SDK config: %v", err)
+		logFatal("Unable to load AWS SDK config", "error", err)
 	}
 
+	// a span per S3, Bedrock and Secrets Manager call
+	otelaws.AppendMiddlewares(&cfg.APIOptions)
+
 	BedrockClient = bedrockruntime.NewFromConfig(cfg)
 	S3Client = s3.NewFromConfig(cfg)
 	SecretManagerClient = secretsmanager.NewFromConfig(cfg)
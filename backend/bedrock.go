@@ -2,50 +2,210 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
-	"log"
+	"log/slog"
+	"strings"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/service/bedrockruntime"
 	"github.com/aws/aws-sdk-go-v2/service/bedrockruntime/types"
 )
 
-func GenerateMovieSummary(movie Movie) (string, error) {
-	log.Print("Inside GenerateMovieSummary func")
-	// Define inference parameters
-	inferenceConfig := &types.InferenceConfiguration{
-		MaxTokens: aws.Int32(500), // Limit response length
+// Movie fields are passed as a delimited data block, never interpolated into the instructions
+func summaryRequest(movie Movie, userId string) GenerationRequest {
+	prompt := "Provide a short summary of 100 words for the movie described below.\n\n" + movieDataBlock(movie)
+
+	return GenerationRequest{
+		System:    "You are a helpful AI assistant that specializes in movie summaries in 100 words. Just return the summary. " + DATA_BLOCK_INSTRUCTION,
+		Messages:  []ChatMessage{{Role: ROLE_USER, Content: prompt}},
+		MaxTokens: 500, // Limit response length
+		Operation: LLM_OP_SUMMARY,
+		UserId:    userId,
 	}
+}
 
-	prompt := fmt.Sprintf("Provide a short summary of 100 words for the movie '%v', released in %d, which falls under the genre %v.", movie.Title, movie.ReleaseYear, movie.Genre)
+func GenerateMovieSummary(ctx context.Context, movie Movie, userId string) (GenerationResult, error) {
+	slog.DebugContext(ctx, "Inside GenerateMovieSummary func")
 
-	// Create converse request for Messages API
-	converseRequest := &bedrockruntime.ConverseInput{
-		ModelId: aws.String(MODEL_ID),
-		Messages: []types.Message{{Role: types.ConversationRoleUser, Content: []types.ContentBlock{
-			&types.ContentBlockMemberText{Value: prompt},
-		}}},
-		System: []types.SystemContentBlock{
-			&types.SystemContentBlockMemberText{Value: "You are a helpful AI assistant that specializes in movie summaries in 100 words. Just return the summary."},
-		},
-		InferenceConfig: inferenceConfig,
+	result, err := Generator.Generate(ctx, summaryRequest(movie, userId))
+	if err != nil {
+		slog.ErrorContext(ctx, "Error generating summary", "movieId", movie.MovieId, "error", err)
+		return result, err
 	}
 
-	output, err := BedrockClient.Converse(context.TODO(), converseRequest)
-	if err != nil {
-		log.Print(err)
-		return "", err
+	if result.Text == "" {
+		return result, newError(ErrUpstream, "model returned an empty summary")
 	}
 
-	outputValue := output.Output.(*types.ConverseOutputMemberMessage).Value
-	if len(outputValue.Content) == 0 {
-		return "", fmt.Errorf("no summary returned")
+	return result, nil
+}
+
+// bedrockGenerator implements SummaryGenerator with the Bedrock Converse API, trying
+// the configured models in order when one is throttled or unavailable
+type bedrockGenerator struct {
+	models     []modelConfig
+	breakers   map[string]*circuitBreaker
+	maxRetries int
+}
 
+func newBedrockGenerator() *bedrockGenerator {
+	g := &bedrockGenerator{
+		models:     loadModelChain(),
+		breakers:   map[string]*circuitBreaker{},
+		maxRetries: appConfig.LLM.MaxRetries,
 	}
-	result := outputValue.Content[0].(*types.ContentBlockMemberText).Value
-	if result == "" {
-		return "", fmt.Errorf("no summary returned")
+
+	cooldown := appConfig.LLM.CircuitCooldown
+	for _, model := range g.models {
+		g.breakers[model.ModelId] = &circuitBreaker{cooldown: cooldown}
 	}
 
-	return result, nil
+	slog.Info("Bedrock model chain", "models", g.models)
+	return g
+}
+
+// Usable when the AWS credentials can be retrieved and at least one model of the chain
+// doesn't have an open circuit. Doesn't call a model, that would cost tokens.
+func (g *bedrockGenerator) Check(ctx context.Context) error {
+	credentials := BedrockClient.Options().Credentials
+	if credentials == nil {
+		return errors.New("no AWS credentials configured")
+	}
+	if _, err := credentials.Retrieve(ctx); err != nil {
+		return fmt.Errorf("cannot retrieve AWS credentials: %v", err)
+	}
+
+	for _, model := range g.models {
+		if g.breakers[model.ModelId].Available() {
+			return nil
+		}
+	}
+	return fmt.Errorf("%w: every model has an open circuit", ErrModelsUnavailable)
+}
+
+// Retries are handled by withFallback, so the SDK should only make a single attempt
+func singleAttempt(o *bedrockruntime.Options) {
+	o.RetryMaxAttempts = 1
+}
+
+func (*bedrockGenerator) converseInput(req GenerationRequest, modelId string) *bedrockruntime.ConverseInput {
+	messages := make([]types.Message, 0, len(req.Messages))
+	for _, message := range req.Messages {
+		role := types.ConversationRoleUser
+		if message.Role == ROLE_ASSISTANT {
+			role = types.ConversationRoleAssistant
+		}
+
+		content := []types.ContentBlock{}
+		for _, image := range message.Images {
+			content = append(content, &types.ContentBlockMemberImage{Value: types.ImageBlock{
+				Format: types.ImageFormat(image.Format),
+				Source: &types.ImageSourceMemberBytes{Value: image.Bytes},
+			}})
+		}
+		content = append(content, &types.ContentBlockMemberText{Value: message.Content})
+
+		messages = append(messages, types.Message{Role: role, Content: content})
+	}
+
+	input := &bedrockruntime.ConverseInput{
+		ModelId:  aws.String(modelId),
+		Messages: messages,
+		// Define inference parameters
+		InferenceConfig: &types.InferenceConfiguration{
+			MaxTokens: aws.Int32(req.MaxTokens),
+		},
+	}
+
+	if req.System != "" {
+		input.System = []types.SystemContentBlock{
+			&types.SystemContentBlockMemberText{Value: req.System},
+		}
+	}
+
+	return input
+}
+
+func (g *bedrockGenerator) Generate(ctx context.Context, req GenerationRequest) (GenerationResult, error) {
+	slog.DebugContext(ctx, "Inside bedrockGenerator.Generate func")
+
+	return g.withFallback(ctx, func(ctx context.Context, modelId string) (GenerationResult, error) {
+		output, err := BedrockClient.Converse(ctx, g.converseInput(req, modelId), singleAttempt)
+		if err != nil {
+			return GenerationResult{}, err
+		}
+
+		var result GenerationResult
+		if output.Usage != nil {
+			result.InputTokens = int(aws.ToInt32(output.Usage.InputTokens))
+			result.OutputTokens = int(aws.ToInt32(output.Usage.OutputTokens))
+		}
+
+		outputValue, ok := output.Output.(*types.ConverseOutputMemberMessage)
+		if !ok || len(outputValue.Value.Content) == 0 {
+			return result, newError(ErrUpstream, "no content returned by the model")
+		}
+
+		if text, ok := outputValue.Value.Content[0].(*types.ContentBlockMemberText); ok {
+			result.Text = text.Value
+		}
+
+		return result, nil
+	}, func() bool { return true })
+}
+
+func (g *bedrockGenerator) GenerateStream(ctx context.Context, req GenerationRequest, onDelta func(string) error) (GenerationResult, error) {
+	slog.DebugContext(ctx, "Inside bedrockGenerator.GenerateStream func")
+
+	// once text reached the client, switching to another model would garble the answer
+	started := false
+
+	return g.withFallback(ctx, func(ctx context.Context, modelId string) (GenerationResult, error) {
+		converseInput := g.converseInput(req, modelId)
+
+		output, err := BedrockClient.ConverseStream(ctx, &bedrockruntime.ConverseStreamInput{
+			ModelId:         converseInput.ModelId,
+			Messages:        converseInput.Messages,
+			System:          converseInput.System,
+			InferenceConfig: converseInput.InferenceConfig,
+		}, singleAttempt)
+		if err != nil {
+			return GenerationResult{}, err
+		}
+
+		stream := output.GetStream()
+		defer stream.Close()
+
+		var result GenerationResult
+		var text strings.Builder
+
+		for event := range stream.Events() {
+			switch e := event.(type) {
+			case *types.ConverseStreamOutputMemberContentBlockDelta:
+				delta, ok := e.Value.Delta.(*types.ContentBlockDeltaMemberText)
+				if !ok {
+					continue
+				}
+
+				started = true
+				text.WriteString(delta.Value)
+				if err := onDelta(delta.Value); err != nil {
+					return result, err
+				}
+			case *types.ConverseStreamOutputMemberMetadata:
+				if e.Value.Usage != nil {
+					result.InputTokens = int(aws.ToInt32(e.Value.Usage.InputTokens))
+					result.OutputTokens = int(aws.ToInt32(e.Value.Usage.OutputTokens))
+				}
+			}
+		}
+
+		if err := stream.Err(); err != nil {
+			return result, err
+		}
+
+		result.Text = text.String()
+		return result, nil
+	}, func() bool { return !started })
 }
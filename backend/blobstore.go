@@ -0,0 +1,458 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/AJ-Walker/movies-rest-api/config"
+	"github.com/gin-gonic/gin"
+)
+
+const s3Prefix = "images"
+
+var ErrObjectNotFound = newError(ErrNotFound, "object not found")
+
+// ObjectInfo describes a stored object
+type ObjectInfo struct {
+	Key          string    `json:"key"`
+	Size         int64     `json:"size"`
+	ContentType  string    `json:"contentType"`
+	ETag         string    `json:"etag"`
+	LastModified time.Time `json:"lastModified"`
+}
+
+// BlobStore is where cover images are kept. Keys are slash separated paths like "images/<uuid>.jpg".
+type BlobStore interface {
+	Put(ctx context.Context, key string, body io.Reader, size int64, contentType string) error
+	Get(ctx context.Context, key string) (io.ReadCloser, ObjectInfo, error)
+	// a seekable reader for serving byte ranges, only the requested ranges are fetched
+	Open(ctx context.Context, key string) (io.ReadSeekCloser, ObjectInfo, error)
+	Delete(ctx context.Context, key string) error
+	Head(ctx context.Context, key string) (ObjectInfo, error)
+	List(ctx context.Context, prefix string) ([]ObjectInfo, error)
+	PublicURL(key string) string
+	// a url the client can upload the object to directly, without going through the API
+	PresignPut(ctx context.Context, key string, contentType string, size int64, expires time.Duration) (PresignedUpload, error)
+	// a short-lived url to download the object even when the store isn't public
+	PresignGet(ctx context.Context, key string, expires time.Duration) (string, error)
+	// check the store is reachable and the credentials work, for /readyz
+	Ping(ctx context.Context) error
+}
+
+// PresignedUpload is what a client needs to upload an object directly to the store
+type PresignedUpload struct {
+	Url       string            `json:"url"`
+	Method    string            `json:"method"`
+	Headers   map[string]string `json:"headers"`
+	ExpiresAt time.Time         `json:"expiresAt"`
+}
+
+var Blobs BlobStore
+
+// Pick the blob store based on the storage.backend setting (BLOB_STORE): "s3" (default) or
+// "local". The local store keeps files under LOCAL_BLOB_DIR and serves them through the router.
+func InitBlobStore(router *gin.Engine) {
+	storage := appConfig.Storage
+
+	switch storage.Backend {
+	case config.STORAGE_LOCAL:
+		dir := storage.LocalDir
+		baseUrl := strings.TrimSuffix(appConfig.Server.PublicBaseURL, "/")
+
+		store, err := newLocalBlobStore(dir, baseUrl+LOCAL_BLOB_ROUTE)
+		if err != nil {
+			logFatal("Cannot initialize local blob store", "error", err)
+		}
+
+		// without a configured secret upload urls stop working when the server restarts
+		if secret := storage.LocalSecret; secret != "" {
+			store.secret = []byte(secret)
+		} else if _, err := rand.Read(store.secret); err != nil {
+			logFatal("Cannot initialize local blob store", "error", err)
+		}
+
+		slog.Info("Using local blob store", "dir", dir)
+		router.GET(LOCAL_BLOB_ROUTE+"/*key", store.serve)
+		router.PUT(LOCAL_BLOB_ROUTE+"/*key", store.upload)
+		Blobs = instrumentedBlobStore{BlobStore: store, backend: config.STORAGE_LOCAL}
+	default:
+		store := &s3BlobStore{client: S3Client, bucket: storage.Bucket, region: appConfig.AWS.Region}
+		Blobs = instrumentedBlobStore{BlobStore: store, backend: config.STORAGE_S3}
+	}
+}
+
+// Public url of a stored object. COVER_BASE_URL (e.g. a CDN domain) takes precedence over
+// the url of the blob store itself, so the bucket, region or CDN can change without
+// touching stored data. With COVER_DELIVERY=proxy or redirect the url points to the
+// image proxy instead, so the bucket can be private.
+func coverPublicURL(key string) string {
+	if coverDelivery() != config.COVER_DELIVERY_PUBLIC {
+		return imageProxyURL(key)
+	}
+
+	if baseUrl := appConfig.Storage.CoverBaseURL; baseUrl != "" {
+		return fmt.Sprintf("%v/%v", strings.TrimSuffix(baseUrl, "/"), key)
+	}
+
+	return Blobs.PublicURL(key)
+}
+
+// Bound a single blob store operation by the storage.timeout setting (BLOB_TIMEOUT)
+func blobContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	return context.WithTimeout(ctx, appConfig.Storage.Timeout)
+}
+
+// Store an object in the blob store
+func putObject(ctx context.Context, key string, data []byte, contentType string) error {
+	slog.DebugContext(ctx, "Inside putObject func")
+
+	ctx, cancel := blobContext(ctx)
+	defer cancel()
+
+	return Blobs.Put(ctx, key, bytes.NewReader(data), int64(len(data)), contentType)
+}
+
+// Read a cover image from the blob store
+func getCoverImage(ctx context.Context, objectKey string) ([]byte, string, error) {
+	slog.DebugContext(ctx, "Inside getCoverImage func")
+
+	ctx, cancel := blobContext(ctx)
+	defer cancel()
+
+	body, info, err := Blobs.Get(ctx, objectKey)
+	if err != nil {
+		return nil, "", err
+	}
+
+	defer body.Close()
+
+	image, err := io.ReadAll(body)
+	if err != nil {
+		slog.ErrorContext(ctx, "Error reading object", "key", objectKey, "error", err)
+		return nil, "", err
+	}
+
+	return image, info.ContentType, nil
+}
+
+// Delete a cover image from the blob store
+func deleteCoverImage(ctx context.Context, objectKey string) error {
+	slog.DebugContext(ctx, "Inside deleteCoverImage func")
+
+	ctx, cancel := blobContext(ctx)
+	defer cancel()
+
+	return Blobs.Delete(ctx, objectKey)
+}
+
+// Delete a set of cover objects, logging the ones that could not be deleted. The deletes
+// run even when ctx is canceled, so a client going away doesn't leave objects behind.
+func deleteCoverObjects(ctx context.Context, keys []string) {
+	ctx = context.WithoutCancel(ctx)
+	for _, key := range keys {
+		if err := deleteCoverImage(ctx, key); err != nil {
+			slog.ErrorContext(ctx, "Error deleting object", "key", key, "error", err)
+		}
+	}
+}
+
+const LOCAL_BLOB_ROUTE = "/files"
+
+// localBlobStore implements BlobStore on the local filesystem for development and tests
+type localBlobStore struct {
+	root    string
+	baseUrl string
+	// signs the upload urls handed out by PresignPut
+	secret []byte
+}
+
+func newLocalBlobStore(root string, baseUrl string) (*localBlobStore, error) {
+	if err := os.MkdirAll(root, 0o755); err != nil {
+		return nil, err
+	}
+
+	return &localBlobStore{root: root, baseUrl: baseUrl, secret: make([]byte, 32)}, nil
+}
+
+// Resolve a key to a path inside the root, refusing keys that would escape it
+func (s *localBlobStore) path(key string) (string, error) {
+	if !filepath.IsLocal(filepath.FromSlash(key)) {
+		return "", invalidField("key", fmt.Sprintf("invalid object key %q", key))
+	}
+
+	return filepath.Join(s.root, filepath.FromSlash(key)), nil
+}
+
+func (s *localBlobStore) info(key string, fileInfo fs.FileInfo) ObjectInfo {
+	return ObjectInfo{
+		Key:          key,
+		Size:         fileInfo.Size(),
+		ContentType:  mime.TypeByExtension(filepath.Ext(key)),
+		ETag:         fmt.Sprintf(`"%x-%x"`, fileInfo.ModTime().UnixNano(), fileInfo.Size()),
+		LastModified: fileInfo.ModTime(),
+	}
+}
+
+func (s *localBlobStore) Put(ctx context.Context, key string, body io.Reader, size int64, contentType string) error {
+	slog.DebugContext(ctx, "Inside localBlobStore.Put func")
+
+	path, err := s.path(key)
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return err
+	}
+
+	// write to a temporary file first so readers never see a partial object
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".upload-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := io.Copy(tmp, body); err != nil {
+		tmp.Close()
+		return err
+	}
+
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), path)
+}
+
+func (s *localBlobStore) Get(ctx context.Context, key string) (io.ReadCloser, ObjectInfo, error) {
+	slog.DebugContext(ctx, "Inside localBlobStore.Get func")
+
+	path, err := s.path(key)
+	if err != nil {
+		return nil, ObjectInfo{}, err
+	}
+
+	file, err := os.Open(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, ObjectInfo{}, ErrObjectNotFound
+	}
+	if err != nil {
+		return nil, ObjectInfo{}, err
+	}
+
+	fileInfo, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, ObjectInfo{}, err
+	}
+
+	return file, s.info(key, fileInfo), nil
+}
+
+func (s *localBlobStore) Open(ctx context.Context, key string) (io.ReadSeekCloser, ObjectInfo, error) {
+	slog.DebugContext(ctx, "Inside localBlobStore.Open func")
+
+	body, info, err := s.Get(ctx, key)
+	if err != nil {
+		return nil, ObjectInfo{}, err
+	}
+
+	// Get returns the open file
+	return body.(*os.File), info, nil
+}
+
+func (s *localBlobStore) Delete(ctx context.Context, key string) error {
+	slog.DebugContext(ctx, "Inside localBlobStore.Delete func")
+
+	path, err := s.path(key)
+	if err != nil {
+		return err
+	}
+
+	// deleting a missing object is not an error, same as S3
+	if err := os.Remove(path); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+
+	return nil
+}
+
+func (s *localBlobStore) Head(ctx context.Context, key string) (ObjectInfo, error) {
+	slog.DebugContext(ctx, "Inside localBlobStore.Head func")
+
+	path, err := s.path(key)
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+
+	fileInfo, err := os.Stat(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return ObjectInfo{}, ErrObjectNotFound
+	}
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+
+	return s.info(key, fileInfo), nil
+}
+
+func (s *localBlobStore) Ping(ctx context.Context) error {
+	info, err := os.Stat(s.root)
+	if err != nil {
+		return err
+	}
+	if !info.IsDir() {
+		return fmt.Errorf("%v is not a directory", s.root)
+	}
+	return nil
+}
+
+func (s *localBlobStore) List(ctx context.Context, prefix string) ([]ObjectInfo, error) {
+	slog.DebugContext(ctx, "Inside localBlobStore.List func")
+
+	var objects []ObjectInfo
+
+	err := filepath.WalkDir(s.root, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if entry.IsDir() || strings.HasPrefix(entry.Name(), ".upload-") {
+			return nil
+		}
+
+		rel, err := filepath.Rel(s.root, path)
+		if err != nil {
+			return err
+		}
+
+		key := filepath.ToSlash(rel)
+		if !strings.HasPrefix(key, prefix) {
+			return nil
+		}
+
+		fileInfo, err := entry.Info()
+		if err != nil {
+			return err
+		}
+
+		objects = append(objects, s.info(key, fileInfo))
+		return nil
+	})
+
+	return objects, err
+}
+
+func (s *localBlobStore) PublicURL(key string) string {
+	return fmt.Sprintf("%v/%v", s.baseUrl, key)
+}
+
+// Local files are always served, the public url is enough
+func (s *localBlobStore) PresignGet(ctx context.Context, key string, expires time.Duration) (string, error) {
+	if _, err := s.path(key); err != nil {
+		return "", err
+	}
+
+	return s.PublicURL(key), nil
+}
+
+// Handler for GET /files/*key, serves the local objects
+func (s *localBlobStore) serve(c *gin.Context) {
+	path, err := s.path(strings.TrimPrefix(c.Param("key"), "/"))
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+
+	if fileInfo, err := os.Stat(path); err != nil || fileInfo.IsDir() {
+		respondError(c, newError(ErrNotFound, "file not found"))
+		return
+	}
+
+	c.File(path)
+}
+
+// Signature of an upload url, covers everything the uploader is allowed to send
+func (s *localBlobStore) sign(key string, contentType string, size int64, expires int64) string {
+	mac := hmac.New(sha256.New, s.secret)
+	fmt.Fprintf(mac, "%v\n%v\n%d\n%d", key, contentType, size, expires)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// Upload url with a signed token in the query, checked by the upload handler
+func (s *localBlobStore) PresignPut(ctx context.Context, key string, contentType string, size int64, expires time.Duration) (PresignedUpload, error) {
+	slog.DebugContext(ctx, "Inside localBlobStore.PresignPut func")
+
+	if _, err := s.path(key); err != nil {
+		return PresignedUpload{}, err
+	}
+
+	expiresAt := time.Now().Add(expires)
+	query := url.Values{}
+	query.Set("size", strconv.FormatInt(size, 10))
+	query.Set("expires", strconv.FormatInt(expiresAt.Unix(), 10))
+	query.Set("signature", s.sign(key, contentType, size, expiresAt.Unix()))
+
+	return PresignedUpload{
+		Url:       fmt.Sprintf("%v/%v?%v", s.baseUrl, key, query.Encode()),
+		Method:    http.MethodPut,
+		Headers:   map[string]string{"Content-Type": contentType},
+		ExpiresAt: expiresAt,
+	}, nil
+}
+
+// Handler for PUT /files/*key, accepts uploads to urls signed by PresignPut
+func (s *localBlobStore) upload(c *gin.Context) {
+	slog.DebugContext(c.Request.Context(), "Inside localBlobStore.upload func")
+
+	key := strings.TrimPrefix(c.Param("key"), "/")
+	contentType := c.GetHeader("Content-Type")
+
+	size, sizeErr := strconv.ParseInt(c.Query("size"), 10, 64)
+	expires, expiresErr := strconv.ParseInt(c.Query("expires"), 10, 64)
+	if sizeErr != nil || expiresErr != nil {
+		respondError(c, newError(ErrForbidden, "invalid upload url"))
+		return
+	}
+
+	signature := s.sign(key, contentType, size, expires)
+	if !hmac.Equal([]byte(signature), []byte(c.Query("signature"))) {
+		respondError(c, newError(ErrForbidden, "invalid upload url or Content-Type"))
+		return
+	}
+
+	if time.Now().Unix() > expires {
+		respondError(c, newError(ErrForbidden, "upload url has expired"))
+		return
+	}
+
+	if c.Request.ContentLength != size {
+		respondError(c, invalidField("Content-Length", fmt.Sprintf("must be %d", size)))
+		return
+	}
+
+	body := http.MaxBytesReader(c.Writer, c.Request.Body, size)
+	if err := s.Put(c.Request.Context(), key, body, size, contentType); err != nil {
+		respondError(c, err)
+		return
+	}
+
+	c.Status(http.StatusOK)
+}
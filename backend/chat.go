@@ -0,0 +1,365 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gin-gonic/gin"
+)
+
+type ChatSession struct {
+	SessionId     string        `json:"sessionId"`
+	MovieId       int           `json:"movieId"`
+	InputTokens   int           `json:"inputTokens"`
+	OutputTokens  int           `json:"outputTokens"`
+	EstimatedCost float64       `json:"estimatedCost"`
+	CreatedAt     time.Time     `json:"createdAt"`
+	Messages      []ChatMessage `json:"messages"`
+}
+
+// Handler for POST /api/movies/:movieId/chat
+func createChatSession(c *gin.Context) {
+	slog.DebugContext(c.Request.Context(), "Inside createChatSession func")
+
+	movieId := c.Param("movieId")
+	if movieId == "" {
+		respondError(c, invalidField("movieId", "cannot be empty"))
+		return
+	}
+
+	movie, err := GetMovieById_DB(c.Request.Context(), movieId)
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+
+	sessionId, err := generateUUID()
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+
+	if err := AddChatSession_DB(c.Request.Context(), sessionId, movie.MovieId); err != nil {
+		respondError(c, err)
+		return
+	}
+
+	data := map[string]string{
+		"sessionId": sessionId,
+	}
+
+	c.JSON(http.StatusOK, response(http.StatusOK, true, "Chat session created", data))
+}
+
+// Handler for GET /api/chat/:sessionId
+func getChatSession(c *gin.Context) {
+	slog.DebugContext(c.Request.Context(), "Inside getChatSession func")
+
+	session, err := GetChatSession_DB(c.Request.Context(), c.Param("sessionId"))
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, response(http.StatusOK, true, "Chat session fetched", session))
+}
+
+// Handler for DELETE /api/chat/:sessionId
+func deleteChatSession(c *gin.Context) {
+	slog.DebugContext(c.Request.Context(), "Inside deleteChatSession func")
+
+	if err := DeleteChatSession_DB(c.Request.Context(), c.Param("sessionId")); err != nil {
+		respondError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, response(http.StatusOK, true, "Chat session deleted", nil))
+}
+
+// Handler for POST /api/chat/:sessionId/messages
+// Answers are streamed back as server-sent events when called with ?stream=true
+func sendChatMessage(c *gin.Context) {
+	slog.DebugContext(c.Request.Context(), "Inside sendChatMessage func")
+
+	question := strings.TrimSpace(c.PostForm("message"))
+	if question == "" {
+		respondError(c, invalidField("message", "cannot be empty"))
+		return
+	}
+
+	if utf8.RuneCountInString(question) > MAX_CHAT_MESSAGE_LENGTH {
+		respondError(c, invalidField("message", fmt.Sprintf("cannot be longer than %d characters", MAX_CHAT_MESSAGE_LENGTH)))
+		return
+	}
+
+	session, err := GetChatSession_DB(c.Request.Context(), c.Param("sessionId"))
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+
+	movie, err := GetMovieById_DB(c.Request.Context(), fmt.Sprint(session.MovieId))
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+
+	system := chatSystemPrompt(movie)
+	messages := append(trimChatHistory(system, session.Messages, question), ChatMessage{Role: ROLE_USER, Content: question})
+
+	req := GenerationRequest{
+		System:    system,
+		Messages:  messages,
+		MaxTokens: CHAT_MAX_TOKENS,
+		Operation: LLM_OP_CHAT,
+		UserId:    llmUser(c),
+	}
+
+	if c.Query("stream") != "true" {
+		result, err := Generator.Generate(c.Request.Context(), req)
+		if err != nil {
+			respondError(c, err)
+			return
+		}
+
+		data, err := saveChatTurn(c.Request.Context(), session, question, result)
+		if err != nil {
+			respondError(c, err)
+			return
+		}
+
+		c.JSON(http.StatusOK, response(http.StatusOK, true, "Chat answer generated", data))
+		return
+	}
+
+	// the headers go out with the first event, errors before it get a regular status
+	startStream := func() {
+		if !c.Writer.Written() {
+			c.Header("Content-Type", "text/event-stream")
+			c.Header("Cache-Control", "no-cache")
+			c.Header("Connection", "keep-alive")
+		}
+	}
+
+	result, err := Generator.GenerateStream(c.Request.Context(), req, func(delta string) error {
+		startStream()
+		c.SSEvent("delta", gin.H{"text": delta})
+		c.Writer.Flush()
+		// stop generating if the client went away
+		return c.Request.Context().Err()
+	})
+	if err != nil {
+		slog.ErrorContext(c.Request.Context(), "Chat stream error", "error", err)
+		streamError(c, err)
+		return
+	}
+
+	data, err := saveChatTurn(c.Request.Context(), session, question, result)
+	if err != nil {
+		streamError(c, err)
+		return
+	}
+
+	startStream()
+	c.SSEvent("done", data)
+	c.Writer.Flush()
+}
+
+// Reply with the problem details of err, as the error event once streaming has started
+// and the 200 status is already sent
+func streamError(c *gin.Context, err error) {
+	if !c.Writer.Written() {
+		respondError(c, err)
+		return
+	}
+
+	c.Error(err)
+
+	problem := problemFor(err)
+	problem.Instance = c.Request.URL.Path
+	problem.RequestId = requestIdFrom(c.Request.Context())
+
+	c.SSEvent("error", problem)
+	c.Writer.Flush()
+}
+
+// Persist the question and answer and return the answer along with the session usage
+func saveChatTurn(ctx context.Context, session ChatSession, question string, result GenerationResult) (gin.H, error) {
+	cost := estimateCost(result.ModelId, result.InputTokens, result.OutputTokens)
+
+	// the answer was paid for, so it's kept even if the client went away right after it
+	if err := AddChatTurn_DB(context.WithoutCancel(ctx), session.SessionId, question, result.Text, result.InputTokens, result.OutputTokens, cost); err != nil {
+		return nil, err
+	}
+
+	return gin.H{
+		"answer": result.Text,
+		"usage": gin.H{
+			"inputTokens":   result.InputTokens,
+			"outputTokens":  result.OutputTokens,
+			"estimatedCost": cost,
+		},
+		"sessionUsage": gin.H{
+			"inputTokens":   session.InputTokens + result.InputTokens,
+			"outputTokens":  session.OutputTokens + result.OutputTokens,
+			"estimatedCost": session.EstimatedCost + cost,
+		},
+	}, nil
+}
+
+// System prompt grounded in the stored movie details so answers stay about this movie
+func chatSystemPrompt(movie Movie) string {
+	summary := "No summary available."
+	if movie.GeneratedSummary != nil && *movie.GeneratedSummary != "" {
+		summary = *movie.GeneratedSummary
+	}
+
+	return fmt.Sprintf(`You are a helpful AI assistant answering questions about one specific movie.
+Base your answers on the movie details below and well-known facts about this movie. If you don't know the answer, say so instead of guessing. Keep answers short.
+%v The same applies to the <summary> block.
+
+%v
+<summary>%v</summary>`, DATA_BLOCK_INSTRUCTION, movieDataBlock(movie), promptEscaper.Replace(summary))
+}
+
+// Keep the most recent history that fits into the context budget together with the
+// system prompt, the new question and the tokens reserved for the answer
+func trimChatHistory(system string, history []ChatMessage, question string) []ChatMessage {
+	budget := CHAT_CONTEXT_TOKENS - int(CHAT_MAX_TOKENS) - estimateTokens(system) - estimateTokens(question)
+
+	start := len(history)
+	for start > 0 {
+		cost := estimateTokens(history[start-1].Content)
+		if cost > budget {
+			break
+		}
+		budget -= cost
+		start--
+	}
+
+	// the conversation sent to the model has to start with a user message
+	for start < len(history) && history[start].Role != ROLE_USER {
+		start++
+	}
+
+	if start > 0 {
+		slog.Debug("Trimmed chat history", "messages", start)
+	}
+
+	return history[start:]
+}
+
+// Create a new chat session for a movie in DB
+func AddChatSession_DB(ctx context.Context, sessionId string, movieId int) error {
+	slog.DebugContext(ctx, "Inside AddChatSession_DB func")
+
+	ctx, cancel := dbContext(ctx)
+	defer cancel()
+
+	_, err := db.ExecContext(ctx, "INSERT INTO chat_sessions (sessionId, movieId) VALUES (?,?)", sessionId, movieId)
+	if err != nil {
+		return fmt.Errorf("AddChatSession_DB error: %v", err)
+	}
+
+	return nil
+}
+
+// Get a chat session with its messages ordered from oldest to newest from DB
+func GetChatSession_DB(ctx context.Context, sessionId string) (ChatSession, error) {
+	slog.DebugContext(ctx, "Inside GetChatSession_DB func")
+
+	ctx, cancel := dbContext(ctx)
+	defer cancel()
+
+	var session ChatSession
+	row := db.QueryRowContext(ctx, "SELECT sessionId, movieId, inputTokens, outputTokens, estimatedCost, createdAt FROM chat_sessions WHERE sessionId = ?", sessionId)
+
+	if err := row.Scan(&session.SessionId, &session.MovieId, &session.InputTokens, &session.OutputTokens, &session.EstimatedCost, &session.CreatedAt); err != nil {
+		if err == sql.ErrNoRows {
+			slog.DebugContext(ctx, "GetChatSession_DB error", "error", err)
+			return session, newError(ErrNotFound, "No chat session found with given sessionId")
+		}
+		return session, fmt.Errorf("GetChatSession_DB error: %v", err)
+	}
+
+	rows, err := db.QueryContext(ctx, "SELECT role, content FROM chat_messages WHERE sessionId = ? ORDER BY messageId", sessionId)
+	if err != nil {
+		return session, fmt.Errorf("GetChatSession_DB error: %v", err)
+	}
+
+	defer rows.Close()
+
+	session.Messages = []ChatMessage{}
+	for rows.Next() {
+		var message ChatMessage
+
+		if err := rows.Scan(&message.Role, &message.Content); err != nil {
+			return session, fmt.Errorf("GetChatSession_DB error: %v", err)
+		}
+
+		session.Messages = append(session.Messages, message)
+	}
+
+	if err := rows.Err(); err != nil {
+		return session, fmt.Errorf("GetChatSession_DB error: %v", err)
+	}
+
+	return session, nil
+}
+
+// Save a question and its answer and add the usage to the session totals in DB
+func AddChatTurn_DB(ctx context.Context, sessionId string, question string, answer string, inputTokens int, outputTokens int, cost float64) error {
+	slog.DebugContext(ctx, "Inside AddChatTurn_DB func")
+
+	ctx, cancel := dbContext(ctx)
+	defer cancel()
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("AddChatTurn_DB error: %v", err)
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx, "INSERT INTO chat_messages (sessionId, role, content) VALUES (?,?,?), (?,?,?)", sessionId, ROLE_USER, question, sessionId, ROLE_ASSISTANT, answer); err != nil {
+		return fmt.Errorf("AddChatTurn_DB error: %v", err)
+	}
+
+	if _, err := tx.ExecContext(ctx, "UPDATE chat_sessions SET inputTokens = inputTokens + ?, outputTokens = outputTokens + ?, estimatedCost = estimatedCost + ? WHERE sessionId = ?", inputTokens, outputTokens, cost, sessionId); err != nil {
+		return fmt.Errorf("AddChatTurn_DB error: %v", err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("AddChatTurn_DB error: %v", err)
+	}
+
+	return nil
+}
+
+// Delete a chat session and its messages from DB
+func DeleteChatSession_DB(ctx context.Context, sessionId string) error {
+	slog.DebugContext(ctx, "Inside DeleteChatSession_DB func")
+
+	ctx, cancel := dbContext(ctx)
+	defer cancel()
+
+	result, err := db.ExecContext(ctx, "DELETE FROM chat_sessions WHERE sessionId = ?", sessionId)
+	if err != nil {
+		return fmt.Errorf("DeleteChatSession_DB error: %v", err)
+	}
+
+	deleted, err := result.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("DeleteChatSession_DB error: %v", err)
+	}
+	if deleted == 0 {
+		return newError(ErrNotFound, "No chat session found with given sessionId")
+	}
+
+	return nil
+}
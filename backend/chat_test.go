@@ -0,0 +1,49 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestStreamError(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	tests := []struct {
+		name        string
+		started     bool
+		status      int
+		contentType string
+		body        string
+	}{
+		{"before the first event", false, http.StatusServiceUnavailable, PROBLEM_CONTENT_TYPE, `"code":"unavailable"`},
+		{"after the first event", true, http.StatusOK, "text/event-stream", "event:error"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			recorder := httptest.NewRecorder()
+			c, _ := gin.CreateTestContext(recorder)
+			c.Request = httptest.NewRequest(http.MethodPost, "/api/chat/1/messages?stream=true", nil)
+
+			if test.started {
+				c.Header("Content-Type", "text/event-stream")
+				c.SSEvent("delta", gin.H{"text": "Hi"})
+			}
+			streamError(c, ErrModelsUnavailable)
+
+			if recorder.Code != test.status {
+				t.Errorf("expected status %d, got %d", test.status, recorder.Code)
+			}
+			if contentType := recorder.Header().Get("Content-Type"); !strings.HasPrefix(contentType, test.contentType) {
+				t.Errorf("expected content type %v, got %v", test.contentType, contentType)
+			}
+			if body := recorder.Body.String(); !strings.Contains(body, test.body) || !strings.Contains(body, ErrModelsUnavailable.Message) {
+				t.Errorf("expected the problem details in %q", body)
+			}
+		})
+	}
+}
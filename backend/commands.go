@@ -0,0 +1,200 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// A one-off command run instead of the API server. Commands with needsDB run after
+// the config is validated and the AWS clients, DB connection and blob store are initialized.
+type command struct {
+	needsDB bool
+	run     func(args []string) int
+}
+
+var commands = map[string]command{
+	"config":  {run: configCommand},
+	"migrate": {needsDB: true, run: migrateCommand},
+	"gc":      {needsDB: true, run: gcCommand},
+	"import":  {needsDB: true, run: importCommand},
+}
+
+// Check if a command needs the DB before it can run
+func commandNeedsDB(name string) bool {
+	return commands[name].needsDB
+}
+
+// Run a one-off command and return the process exit code
+func runCommand(name string, args []string) int {
+	cmd, ok := commands[name]
+	if !ok {
+		var names []string
+		for name := range commands {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+
+		fmt.Printf("Unknown command %q. Available commands: %v\n", name, strings.Join(names, ", "))
+		return 2
+	}
+
+	return cmd.run(args)
+}
+
+// Print the effective config with secrets redacted and check it, e.g. `go run . -config config.yaml config`
+func configCommand(args []string) int {
+	fmt.Print(appConfig)
+
+	if err := appConfig.Validate(); err != nil {
+		slog.Error("Invalid configuration", "error", err)
+		return 1
+	}
+
+	slog.Info("Configuration is valid")
+	return 0
+}
+
+// Apply pending schema migrations
+func migrateCommand(args []string) int {
+	applied, err := RunMigrations_DB(context.Background())
+	for _, version := range applied {
+		slog.Info("Applied migration", "version", version)
+	}
+
+	if err != nil {
+		slog.Error("Migration failed", "error", err)
+		return 1
+	}
+
+	if len(applied) == 0 {
+		slog.Info("Schema is up to date")
+	}
+
+	// duplicates the unique title migration renamed, until editors merge or delete them
+	conflicts, err := GetMovieTitleConflicts_DB(context.Background())
+	if err != nil {
+		slog.Error("Error reading title conflicts", "error", err)
+		return 1
+	}
+	for _, conflict := range conflicts {
+		fmt.Printf("conflict\t%d\tduplicate of %d\t%d\t%q\n", conflict.MovieId, conflict.KeptMovieId, conflict.ReleaseYear, conflict.OriginalTitle)
+	}
+	if len(conflicts) > 0 {
+		slog.Warn("Movies were renamed to make titles unique per release year, merge or delete them", "conflicts", len(conflicts))
+	}
+	return 0
+}
+
+// Report orphaned objects and dangling references, e.g. `go run . gc -delete -grace 48h`
+func gcCommand(args []string) int {
+	flags := flag.NewFlagSet("gc", flag.ContinueOnError)
+	deleteOrphans := flags.Bool("delete", false, "delete orphans older than the grace period")
+	grace := flags.Duration("grace", appConfig.GC.Grace, "minimum age of an orphan before it is deleted")
+	asJson := flags.Bool("json", false, "print the full report as JSON")
+
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+
+	report, err := reconcileStorage(context.Background(), *deleteOrphans, *grace)
+	if err != nil {
+		slog.Error("Storage reconciliation failed", "error", err)
+		return 1
+	}
+
+	if *asJson {
+		output, _ := json.MarshalIndent(report, "", "  ")
+		fmt.Println(string(output))
+	} else {
+		for _, orphan := range report.Orphans {
+			fmt.Printf("orphan\t%v\t%d bytes\t%v\tdeleted=%v\n", orphan.Key, orphan.Size, orphan.LastModified.Format(time.RFC3339), orphan.Deleted)
+		}
+		for _, dangling := range report.Dangling {
+			fmt.Printf("dangling\t%v\t%v\n", dangling.Key, dangling.Reference)
+		}
+	}
+
+	logReconcileReport(report)
+
+	if len(report.DeleteErrors) > 0 {
+		return 1
+	}
+	return 0
+}
+
+// Add the movies of a JSON file, an array of {"title", "releaseYear", "genre"} objects, e.g.
+// `go run . import -dry-run movies.json`. Entries are checked with the same rules as the API
+// and nothing is added while any of them is invalid.
+func importCommand(args []string) int {
+	flags := flag.NewFlagSet("import", flag.ContinueOnError)
+	dryRun := flags.Bool("dry-run", false, "only validate the file")
+
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	if flags.NArg() != 1 {
+		fmt.Println("Usage: import [-dry-run] FILE")
+		return 2
+	}
+
+	data, err := os.ReadFile(flags.Arg(0))
+	if err != nil {
+		slog.Error("Error reading import file", "error", err)
+		return 1
+	}
+
+	var inputs []MovieInput
+	if err := json.Unmarshal(data, &inputs); err != nil {
+		slog.Error("Import file is not a JSON array of movies", "error", err)
+		return 1
+	}
+
+	var movies []Movie
+	invalid := 0
+	for i, input := range inputs {
+		movie, err := input.Validate()
+		if err == nil {
+			movies = append(movies, movie)
+			continue
+		}
+
+		invalid++
+		var appErr *AppError
+		if errors.As(err, &appErr) {
+			for _, field := range appErr.Fields {
+				fmt.Printf("invalid\t%d\t%q\t%v: %v\n", i+1, input.Title, field.Field, field.Message)
+			}
+		}
+	}
+
+	if invalid > 0 {
+		slog.Error("Import file has invalid movies, nothing was added", "invalid", invalid, "movies", len(inputs))
+		return 1
+	}
+	if *dryRun {
+		slog.Info("All movies are valid", "movies", len(inputs))
+		return 0
+	}
+
+	failed := 0
+	for i, movie := range movies {
+		if _, err := createMovie(context.Background(), movie, coverUpload{}); err != nil {
+			failed++
+			fmt.Printf("failed\t%d\t%q\t%v\n", i+1, movie.Title, err)
+		}
+	}
+
+	slog.Info("Imported movies", "added", len(movies)-failed, "failed", failed)
+	if failed > 0 {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,476 @@
+// Package config holds the typed settings of the API. Settings are loaded from defaults,
+// an optional YAML or TOML file, environment variables and command line flags, each
+// overriding the previous one, and validated once at startup.
+package config
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/url"
+	"reflect"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Every setting has a `yaml` key (also used for TOML files), an `env` variable and
+// optionally a `flag`. Settings tagged `secret` are redacted when printed.
+type Config struct {
+	Server   Server   `yaml:"server"`
+	Log      Log      `yaml:"log"`
+	Tracing  Tracing  `yaml:"tracing"`
+	Health   Health   `yaml:"health"`
+	Database Database `yaml:"database"`
+	Secrets  Secrets  `yaml:"secrets"`
+	AWS      AWS      `yaml:"aws"`
+	Storage  Storage  `yaml:"storage"`
+	GC       GC       `yaml:"gc"`
+	LLM      LLM      `yaml:"llm"`
+}
+
+type Server struct {
+	ListenAddr    string `yaml:"listenAddr" env:"LISTEN_ADDR" flag:"listen-addr" usage:"address the API listens on"`
+	PublicBaseURL string `yaml:"publicBaseUrl" env:"PUBLIC_BASE_URL" flag:"public-base-url" usage:"url clients reach the API on"`
+	// how long /readyz fails before the listener closes, so load balancers stop routing here
+	ShutdownDelay time.Duration `yaml:"shutdownDelay" env:"SHUTDOWN_DELAY" flag:"shutdown-delay" usage:"how long /readyz reports shutting down before connections are drained"`
+	// how long in-flight requests and background jobs get to finish on SIGTERM
+	ShutdownTimeout   time.Duration `yaml:"shutdownTimeout" env:"SHUTDOWN_TIMEOUT" flag:"shutdown-timeout" usage:"how long to drain in-flight requests on shutdown"`
+	ReadHeaderTimeout time.Duration `yaml:"readHeaderTimeout" env:"READ_HEADER_TIMEOUT" flag:"read-header-timeout" usage:"how long a client gets to send the request headers"`
+	IdleTimeout       time.Duration `yaml:"idleTimeout" env:"IDLE_TIMEOUT" flag:"idle-timeout" usage:"how long an idle keep-alive connection is kept open"`
+}
+
+type Log struct {
+	// debug also logs every function call and request field
+	Level  string `yaml:"level" env:"LOG_LEVEL" flag:"log-level" usage:"minimum log level: debug, info, warn or error"`
+	Format string `yaml:"format" env:"LOG_FORMAT" flag:"log-format" usage:"log output: json or text"`
+}
+
+// env variables follow the OpenTelemetry conventions where there is one
+type Tracing struct {
+	// none disables tracing, stdout prints spans for local debugging
+	Exporter string `yaml:"exporter" env:"OTEL_TRACES_EXPORTER" flag:"traces-exporter" usage:"where spans are sent: none, otlp or stdout"`
+	// e.g. http://otel-collector:4318, empty for the OTLP default
+	Endpoint    string  `yaml:"endpoint" env:"OTEL_EXPORTER_OTLP_ENDPOINT" flag:"otlp-endpoint" usage:"url of the OTLP/HTTP collector"`
+	ServiceName string  `yaml:"serviceName" env:"OTEL_SERVICE_NAME" flag:"service-name" usage:"service name on spans"`
+	SampleRatio float64 `yaml:"sampleRatio" env:"TRACE_SAMPLE_RATIO" flag:"trace-sample-ratio" usage:"share of new traces that are sampled, 0 to 1"`
+}
+
+type Health struct {
+	Timeout  time.Duration `yaml:"timeout" env:"HEALTH_CHECK_TIMEOUT" flag:"health-timeout" usage:"maximum duration of a single readiness check"`
+	CacheTTL time.Duration `yaml:"cacheTtl" env:"HEALTH_CACHE_TTL" flag:"health-cache-ttl" usage:"how long readiness results are reused"`
+	// a failing optional dependency makes /readyz report degraded instead of unavailable
+	Optional string `yaml:"optional" env:"HEALTH_OPTIONAL" flag:"health-optional" usage:"comma separated checks that only degrade readiness: database, storage or generator"`
+}
+
+type Database struct {
+	Host string `yaml:"host" env:"DB_HOST" flag:"db-host" usage:"MySQL host"`
+	Port int    `yaml:"port" env:"DB_PORT" flag:"db-port" usage:"MySQL port"`
+	User string `yaml:"user" env:"DB_USER" flag:"db-user" usage:"MySQL user"`
+	Name string `yaml:"name" env:"DB_NAME" flag:"db-name" usage:"MySQL database"`
+	// an env variable, a file name or a Secrets Manager id, depending on the secrets provider
+	PasswordSecret string `yaml:"passwordSecret" env:"DB_PASSWORD_SECRET" flag:"db-password-secret" usage:"secret holding the DB password"`
+	// empty when the secret is the plain password
+	SecretKey    string        `yaml:"secretKey" env:"DB_SECRET_KEY" flag:"db-secret-key" usage:"key of the DB password in a JSON secret"`
+	QueryTimeout time.Duration `yaml:"queryTimeout" env:"DB_QUERY_TIMEOUT" flag:"db-query-timeout" usage:"maximum duration of a single DB operation"`
+}
+
+type Secrets struct {
+	Provider string        `yaml:"provider" env:"SECRETS_PROVIDER" flag:"secrets-provider" usage:"where secrets are read from: env, file or aws"`
+	Dir      string        `yaml:"dir" env:"SECRETS_DIR" flag:"secrets-dir" usage:"directory of the file secrets provider, e.g. Docker or Kubernetes secrets"`
+	CacheTTL time.Duration `yaml:"cacheTtl" env:"SECRETS_CACHE_TTL" flag:"secrets-cache-ttl" usage:"how long a fetched secret is reused"`
+}
+
+type AWS struct {
+	Region string `yaml:"region" env:"AWS_REGION" flag:"aws-region" usage:"AWS region of the bucket, Bedrock and Secrets Manager"`
+}
+
+type Storage struct {
+	Backend     string `yaml:"backend" env:"BLOB_STORE" flag:"blob-store" usage:"blob store for images: s3 or local"`
+	Bucket      string `yaml:"bucket" env:"BUCKET_NAME" flag:"bucket" usage:"S3 bucket for images"`
+	LocalDir    string `yaml:"localDir" env:"LOCAL_BLOB_DIR" flag:"local-blob-dir" usage:"directory of the local blob store"`
+	LocalSecret string `yaml:"localSecret" env:"LOCAL_BLOB_SECRET" secret:"true"`
+	// e.g. a CDN domain in front of the bucket or the image proxy
+	CoverBaseURL   string `yaml:"coverBaseUrl" env:"COVER_BASE_URL" flag:"cover-base-url" usage:"base url of cover images"`
+	CoverDelivery  string `yaml:"coverDelivery" env:"COVER_DELIVERY" flag:"cover-delivery" usage:"how cover urls are served: public, proxy or redirect"`
+	ImageURLSecret string `yaml:"imageUrlSecret" env:"IMAGE_URL_SECRET" secret:"true"`
+	// per put, get, head or delete, not for streaming an image to a client
+	Timeout time.Duration `yaml:"timeout" env:"BLOB_TIMEOUT" flag:"blob-timeout" usage:"maximum duration of a single blob store operation"`
+}
+
+type GC struct {
+	// 0 disables the periodic reconciliation
+	Interval time.Duration `yaml:"interval" env:"STORAGE_GC_INTERVAL" flag:"gc-interval" usage:"how often storage is reconciled, 0 disables it"`
+	Delete   bool          `yaml:"delete" env:"STORAGE_GC_DELETE" flag:"gc-delete" usage:"delete orphaned objects instead of only reporting them"`
+	Grace    time.Duration `yaml:"grace" env:"STORAGE_GC_GRACE" flag:"gc-grace" usage:"minimum age of an orphan before it is deleted"`
+}
+
+type LLM struct {
+	Generator string `yaml:"generator" env:"SUMMARY_GENERATOR" flag:"generator" usage:"summary generator: bedrock or fake"`
+	ModelId   string `yaml:"modelId" env:"MODEL_ID" flag:"model-id" usage:"default Bedrock model"`
+	// comma separated modelId or modelId=timeout entries, the default model when empty
+	Models          string        `yaml:"models" env:"BEDROCK_MODELS" flag:"models" usage:"ordered Bedrock fallback chain, e.g. modelA=20s,modelB=10s"`
+	MaxRetries      int           `yaml:"maxRetries" env:"BEDROCK_MAX_RETRIES" flag:"max-retries" usage:"retries per model on throttling"`
+	CircuitCooldown time.Duration `yaml:"circuitCooldown" env:"BEDROCK_CIRCUIT_COOLDOWN" flag:"circuit-cooldown" usage:"how long a failing model is skipped"`
+	// 0 means no limit
+	MonthlyBudgetUSD float64 `yaml:"monthlyBudgetUsd" env:"LLM_MONTHLY_BUDGET_USD" flag:"monthly-budget-usd" usage:"monthly LLM spend limit in USD, 0 for no limit"`
+}
+
+const (
+	STORAGE_S3    string = "s3"
+	STORAGE_LOCAL string = "local"
+
+	LOG_JSON string = "json"
+	LOG_TEXT string = "text"
+
+	TRACES_NONE   string = "none"
+	TRACES_OTLP   string = "otlp"
+	TRACES_STDOUT string = "stdout"
+
+	CHECK_DATABASE  string = "database"
+	CHECK_STORAGE   string = "storage"
+	CHECK_GENERATOR string = "generator"
+
+	SECRETS_ENV  string = "env"
+	SECRETS_FILE string = "file"
+	SECRETS_AWS  string = "aws"
+
+	GENERATOR_BEDROCK string = "bedrock"
+	GENERATOR_FAKE    string = "fake"
+
+	COVER_DELIVERY_PUBLIC   string = "public"   // straight from the bucket or CDN
+	COVER_DELIVERY_PROXY    string = "proxy"    // streamed by the API
+	COVER_DELIVERY_REDIRECT string = "redirect" // the API redirects to a presigned url
+
+	REDACTED string = "********"
+)
+
+// Defaults are what the API runs with when nothing is configured
+func Defaults() *Config {
+	return &Config{
+		Server: Server{
+			ListenAddr:        "localhost:8080",
+			PublicBaseURL:     "http://localhost:8080",
+			ShutdownTimeout:   30 * time.Second,
+			ReadHeaderTimeout: 10 * time.Second,
+			IdleTimeout:       2 * time.Minute,
+		},
+		Log: Log{
+			Level:  "info",
+			Format: LOG_JSON,
+		},
+		Tracing: Tracing{
+			Exporter:    TRACES_NONE,
+			ServiceName: "movies-rest-api",
+			SampleRatio: 1,
+		},
+		Health: Health{
+			Timeout:  2 * time.Second,
+			CacheTTL: 5 * time.Second,
+			Optional: CHECK_GENERATOR,
+		},
+		Database: Database{
+			Host:           "127.0.0.1",
+			Port:           3306,
+			PasswordSecret: "DB_PASSWORD",
+			QueryTimeout:   10 * time.Second,
+		},
+		Secrets: Secrets{
+			Provider: SECRETS_ENV,
+			Dir:      "/run/secrets",
+			CacheTTL: 5 * time.Minute,
+		},
+		AWS: AWS{
+			Region: "ap-south-1",
+		},
+		Storage: Storage{
+			Backend:       STORAGE_S3,
+			Bucket:        "movies-api-data",
+			LocalDir:      "./data/blobs",
+			CoverDelivery: COVER_DELIVERY_PUBLIC,
+			Timeout:       time.Minute,
+		},
+		GC: GC{
+			Grace: 24 * time.Hour,
+		},
+		LLM: LLM{
+			Generator:       GENERATOR_BEDROCK,
+			ModelId:         "anthropic.claude-3-sonnet-20240229-v1:0",
+			MaxRetries:      2,
+			CircuitCooldown: time.Minute,
+		},
+	}
+}
+
+// Validate checks every setting and reports all problems at once
+func (c *Config) Validate() error {
+	var problems []string
+	problem := func(setting string, format string, args ...any) {
+		problems = append(problems, fmt.Sprintf("%v: %v", describe(c, setting), fmt.Sprintf(format, args...)))
+	}
+
+	if _, _, err := net.SplitHostPort(c.Server.ListenAddr); err != nil {
+		problem("server.listenAddr", "must be host:port, got %q", c.Server.ListenAddr)
+	}
+	if !isHTTPURL(c.Server.PublicBaseURL) {
+		problem("server.publicBaseUrl", "must be an http or https url, got %q", c.Server.PublicBaseURL)
+	}
+
+	positive := func(setting string, value time.Duration) {
+		if value <= 0 {
+			problem(setting, "must be positive, got %v", value)
+		}
+	}
+	positive("server.shutdownTimeout", c.Server.ShutdownTimeout)
+	if c.Server.ShutdownDelay < 0 {
+		problem("server.shutdownDelay", "cannot be negative")
+	}
+	positive("server.readHeaderTimeout", c.Server.ReadHeaderTimeout)
+	positive("server.idleTimeout", c.Server.IdleTimeout)
+	positive("database.queryTimeout", c.Database.QueryTimeout)
+	positive("storage.timeout", c.Storage.Timeout)
+
+	if _, err := c.Log.SlogLevel(); err != nil {
+		problem("log.level", "must be debug, info, warn or error, got %q", c.Log.Level)
+	}
+	switch c.Log.Format {
+	case LOG_JSON, LOG_TEXT:
+	default:
+		problem("log.format", "must be json or text, got %q", c.Log.Format)
+	}
+
+	switch c.Tracing.Exporter {
+	case TRACES_NONE, TRACES_OTLP, TRACES_STDOUT:
+	default:
+		problem("tracing.exporter", "must be none, otlp or stdout, got %q", c.Tracing.Exporter)
+	}
+	if c.Tracing.Endpoint != "" && !isHTTPURL(c.Tracing.Endpoint) {
+		problem("tracing.endpoint", "must be an http or https url, got %q", c.Tracing.Endpoint)
+	}
+	if c.Tracing.ServiceName == "" {
+		problem("tracing.serviceName", "is required")
+	}
+	if c.Tracing.SampleRatio < 0 || c.Tracing.SampleRatio > 1 {
+		problem("tracing.sampleRatio", "must be between 0 and 1, got %v", c.Tracing.SampleRatio)
+	}
+
+	positive("health.timeout", c.Health.Timeout)
+	if c.Health.CacheTTL < 0 {
+		problem("health.cacheTtl", "cannot be negative")
+	}
+	for _, check := range c.Health.OptionalChecks() {
+		switch check {
+		case CHECK_DATABASE, CHECK_STORAGE, CHECK_GENERATOR:
+		default:
+			problem("health.optional", "unknown check %q, must be database, storage or generator", check)
+		}
+	}
+
+	if c.Database.Host == "" {
+		problem("database.host", "is required")
+	}
+	if c.Database.Port < 1 || c.Database.Port > 65535 {
+		problem("database.port", "must be between 1 and 65535, got %d", c.Database.Port)
+	}
+	if c.Database.User == "" {
+		problem("database.user", "is required")
+	}
+	if c.Database.Name == "" {
+		problem("database.name", "is required")
+	}
+	if c.Database.PasswordSecret == "" {
+		problem("database.passwordSecret", "is required")
+	}
+
+	switch c.Secrets.Provider {
+	case SECRETS_ENV, SECRETS_AWS:
+	case SECRETS_FILE:
+		if c.Secrets.Dir == "" {
+			problem("secrets.dir", "is required for the file secrets provider")
+		}
+	default:
+		problem("secrets.provider", "must be env, file or aws, got %q", c.Secrets.Provider)
+	}
+	if c.Secrets.CacheTTL < 0 {
+		problem("secrets.cacheTtl", "cannot be negative")
+	}
+
+	if c.AWS.Region == "" {
+		problem("aws.region", "is required")
+	}
+
+	switch c.Storage.Backend {
+	case STORAGE_S3:
+		if c.Storage.Bucket == "" {
+			problem("storage.bucket", "is required for the s3 blob store")
+		}
+	case STORAGE_LOCAL:
+		if c.Storage.LocalDir == "" {
+			problem("storage.localDir", "is required for the local blob store")
+		}
+	default:
+		problem("storage.backend", "must be s3 or local, got %q", c.Storage.Backend)
+	}
+	if c.Storage.CoverBaseURL != "" && !isHTTPURL(c.Storage.CoverBaseURL) {
+		problem("storage.coverBaseUrl", "must be an http or https url, got %q", c.Storage.CoverBaseURL)
+	}
+	switch c.Storage.CoverDelivery {
+	case COVER_DELIVERY_PUBLIC:
+	case COVER_DELIVERY_PROXY, COVER_DELIVERY_REDIRECT:
+		// unsigned proxy urls would serve every image of a private bucket to anyone
+		if c.Storage.ImageURLSecret == "" {
+			problem("storage.imageUrlSecret", "is required when storage.coverDelivery is %v", c.Storage.CoverDelivery)
+		}
+	default:
+		problem("storage.coverDelivery", "must be public, proxy or redirect, got %q", c.Storage.CoverDelivery)
+	}
+
+	if c.GC.Interval < 0 {
+		problem("gc.interval", "cannot be negative")
+	}
+	if c.GC.Grace < 0 {
+		problem("gc.grace", "cannot be negative")
+	}
+
+	switch c.LLM.Generator {
+	case GENERATOR_BEDROCK, GENERATOR_FAKE:
+	default:
+		problem("llm.generator", "must be bedrock or fake, got %q", c.LLM.Generator)
+	}
+	if c.LLM.ModelId == "" {
+		problem("llm.modelId", "is required")
+	}
+	if _, err := c.LLM.ModelChain(time.Second); err != nil {
+		problem("llm.models", "%v", err)
+	}
+	if c.LLM.MaxRetries < 0 {
+		problem("llm.maxRetries", "cannot be negative")
+	}
+	if c.LLM.CircuitCooldown < 0 {
+		problem("llm.circuitCooldown", "cannot be negative")
+	}
+	if c.LLM.MonthlyBudgetUSD < 0 {
+		problem("llm.monthlyBudgetUsd", "cannot be negative")
+	}
+
+	if len(problems) > 0 {
+		return fmt.Errorf("invalid configuration:\n  %v", strings.Join(problems, "\n  "))
+	}
+	return nil
+}
+
+// SlogLevel parses the level name, case insensitive
+func (l Log) SlogLevel() (slog.Level, error) {
+	var level slog.Level
+	err := level.UnmarshalText([]byte(l.Level))
+	return level, err
+}
+
+// Names of the checks marked optional
+func (h Health) OptionalChecks() []string {
+	var checks []string
+	for _, check := range strings.Split(h.Optional, ",") {
+		if check = strings.TrimSpace(check); check != "" {
+			checks = append(checks, check)
+		}
+	}
+	return checks
+}
+
+// ModelSpec is one entry of the Bedrock fallback chain
+type ModelSpec struct {
+	ModelId string
+	Timeout time.Duration
+}
+
+// Parse the fallback chain, entries without a timeout get the default one. An empty
+// chain falls back to the default model.
+func (l LLM) ModelChain(defaultTimeout time.Duration) ([]ModelSpec, error) {
+	if strings.TrimSpace(l.Models) == "" {
+		return []ModelSpec{{ModelId: l.ModelId, Timeout: defaultTimeout}}, nil
+	}
+
+	var models []ModelSpec
+	for _, entry := range strings.Split(l.Models, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		model := ModelSpec{ModelId: entry, Timeout: defaultTimeout}
+		if modelId, timeout, ok := strings.Cut(entry, "="); ok {
+			duration, err := time.ParseDuration(timeout)
+			if err != nil || duration <= 0 {
+				return nil, fmt.Errorf("invalid timeout %q for model %v", timeout, modelId)
+			}
+			model = ModelSpec{ModelId: modelId, Timeout: duration}
+		}
+
+		models = append(models, model)
+	}
+
+	if len(models) == 0 {
+		return nil, errors.New("does not contain any model")
+	}
+
+	return models, nil
+}
+
+// Redacted returns a copy with every secret setting masked, safe to print or log
+func (c *Config) Redacted() *Config {
+	redacted := *c
+	eachSetting(&redacted, func(s setting) {
+		if s.field.Tag.Get("secret") == "true" && s.value.String() != "" {
+			s.value.SetString(REDACTED)
+		}
+	})
+	return &redacted
+}
+
+// YAML of the redacted config, in the same layout a config file uses
+func (c *Config) String() string {
+	output, err := yaml.Marshal(c.Redacted())
+	if err != nil {
+		return fmt.Sprintf("cannot print config: %v", err)
+	}
+	return string(output)
+}
+
+// "llm.models (BEDROCK_MODELS)", so an error points to the file key and the env variable
+func describe(c *Config, key string) string {
+	description := key
+	eachSetting(c, func(s setting) {
+		if s.key == key {
+			description = fmt.Sprintf("%v (%v)", key, s.field.Tag.Get("env"))
+		}
+	})
+	return description
+}
+
+func isHTTPURL(value string) bool {
+	parsed, err := url.Parse(value)
+	return err == nil && (parsed.Scheme == "http" || parsed.Scheme == "https") && parsed.Host != ""
+}
+
+// setting is a single leaf of the config, key is its dotted file key, e.g. "database.port"
+type setting struct {
+	key   string
+	field reflect.StructField
+	value reflect.Value
+}
+
+// Call fn for every setting, in declaration order
+func eachSetting(c *Config, fn func(setting)) {
+	sections := reflect.ValueOf(c).Elem()
+	for i := 0; i < sections.NumField(); i++ {
+		section := sections.Field(i)
+		sectionKey := sections.Type().Field(i).Tag.Get("yaml")
+
+		for j := 0; j < section.NumField(); j++ {
+			field := section.Type().Field(j)
+			fn(setting{key: sectionKey + "." + field.Tag.Get("yaml"), field: field, value: section.Field(j)})
+		}
+	}
+}
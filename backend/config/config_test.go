@@ -0,0 +1,208 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Write a config file into a temporary directory and return its path
+func writeFile(t *testing.T, name string, content string) string {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatalf("cannot write %v: %v", name, err)
+	}
+	return path
+}
+
+// A config that passes Validate, for tests that break one thing at a time
+func validConfig() *Config {
+	cfg := Defaults()
+	cfg.Database.User = "movies"
+	cfg.Database.Name = "movies"
+	return cfg
+}
+
+func TestLoadPrecedence(t *testing.T) {
+	file := writeFile(t, "config.yaml", "database:\n  port: 3307\nserver:\n  shutdownTimeout: 45s\n")
+
+	tests := []struct {
+		name    string
+		file    bool
+		env     map[string]string
+		args    []string
+		port    int
+		timeout time.Duration
+	}{
+		{"defaults", false, nil, nil, 3306, 30 * time.Second},
+		{"file over defaults", true, nil, nil, 3307, 45 * time.Second},
+		{"env over file", true, map[string]string{"DB_PORT": "3308"}, nil, 3308, 45 * time.Second},
+		{"flag over env", true, map[string]string{"DB_PORT": "3308", "SHUTDOWN_TIMEOUT": "50s"}, []string{"-db-port", "3309"}, 3309, 50 * time.Second},
+		{"empty env is ignored", true, map[string]string{"DB_PORT": ""}, nil, 3307, 45 * time.Second},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			t.Setenv("CONFIG_FILE", "")
+			t.Setenv("DB_PORT", "")
+			t.Setenv("SHUTDOWN_TIMEOUT", "")
+			for name, value := range test.env {
+				t.Setenv(name, value)
+			}
+
+			args := test.args
+			if test.file {
+				args = append([]string{"-config", file}, args...)
+			}
+
+			cfg, rest, err := Load(append(args, "migrate"))
+			if err != nil {
+				t.Fatalf("unexpected error %v", err)
+			}
+			if cfg.Database.Port != test.port {
+				t.Errorf("expected database.port %d, got %d", test.port, cfg.Database.Port)
+			}
+			if cfg.Server.ShutdownTimeout != test.timeout {
+				t.Errorf("expected server.shutdownTimeout %v, got %v", test.timeout, cfg.Server.ShutdownTimeout)
+			}
+			if len(rest) != 1 || rest[0] != "migrate" {
+				t.Errorf("expected the command to be left over, got %v", rest)
+			}
+		})
+	}
+}
+
+func TestLoadFile(t *testing.T) {
+	tests := []struct {
+		name    string
+		file    string
+		content string
+		problem string // empty when the file is valid
+	}{
+		{"yaml", "config.yaml", "database:\n  host: db\nllm:\n  models: [a, b]\n", ""},
+		{"toml", "config.toml", "[database]\nhost = \"db\"\n\n[llm]\nmodels = [\"a\", \"b\"]\n", ""},
+		{"yaml unknown key", "config.yaml", "database:\n  hots: db\n", "database.hots: unknown setting"},
+		{"toml unknown key", "config.toml", "[database]\nhots = \"db\"\n", "database.hots: unknown setting"},
+		{"yaml unknown section", "config.yml", "databse:\n  host: db\n", "databse.host: unknown setting"},
+		{"yaml not a section", "config.yaml", "database: db\n", "database: must be a section"},
+		{"toml bad value", "config.toml", "[database]\nport = \"abc\"\n", `database.port: "abc" is not a whole number`},
+		{"unsupported extension", "config.json", "{}", "must be .yaml, .yml or .toml"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			cfg := Defaults()
+			err := cfg.loadFile(writeFile(t, test.file, test.content))
+
+			if test.problem == "" {
+				if err != nil {
+					t.Fatalf("unexpected error %v", err)
+				}
+				if cfg.Database.Host != "db" || cfg.LLM.Models != "a,b" {
+					t.Errorf("expected host db and models a,b, got %q and %q", cfg.Database.Host, cfg.LLM.Models)
+				}
+				return
+			}
+
+			if err == nil || !strings.Contains(err.Error(), test.problem) {
+				t.Errorf("expected an error containing %q, got %v", test.problem, err)
+			}
+		})
+	}
+}
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		name     string
+		change   func(cfg *Config)
+		problems []string
+	}{
+		{"valid", func(cfg *Config) {}, nil},
+		{"every problem at once", func(cfg *Config) {
+			cfg.Database.Host = ""
+			cfg.Database.Port = 0
+			cfg.Log.Level = "loud"
+			cfg.Storage.Backend = "ftp"
+		}, []string{"database.host (DB_HOST)", "database.port (DB_PORT)", "log.level (LOG_LEVEL)", "storage.backend (BLOB_STORE)"}},
+		{"public covers without secret", func(cfg *Config) {
+			cfg.Storage.CoverDelivery = COVER_DELIVERY_PUBLIC
+		}, nil},
+		{"proxy covers without secret", func(cfg *Config) {
+			cfg.Storage.CoverDelivery = COVER_DELIVERY_PROXY
+		}, []string{"storage.imageUrlSecret (IMAGE_URL_SECRET): is required when storage.coverDelivery is proxy"}},
+		{"redirect covers without secret", func(cfg *Config) {
+			cfg.Storage.CoverDelivery = COVER_DELIVERY_REDIRECT
+		}, []string{"storage.imageUrlSecret (IMAGE_URL_SECRET): is required when storage.coverDelivery is redirect"}},
+		{"proxy covers with secret", func(cfg *Config) {
+			cfg.Storage.CoverDelivery = COVER_DELIVERY_PROXY
+			cfg.Storage.ImageURLSecret = "secret"
+		}, nil},
+		{"unknown cover delivery", func(cfg *Config) {
+			cfg.Storage.CoverDelivery = "cdn"
+		}, []string{"storage.coverDelivery (COVER_DELIVERY): must be public, proxy or redirect"}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			cfg := validConfig()
+			test.change(cfg)
+			err := cfg.Validate()
+
+			if len(test.problems) == 0 {
+				if err != nil {
+					t.Errorf("unexpected error %v", err)
+				}
+				return
+			}
+
+			if err == nil {
+				t.Fatalf("expected problems %v", test.problems)
+			}
+			for _, problem := range test.problems {
+				if !strings.Contains(err.Error(), problem) {
+					t.Errorf("expected %q in %v", problem, err)
+				}
+			}
+			// one line per problem after the heading
+			if lines := strings.Count(err.Error(), "\n"); lines != len(test.problems) {
+				t.Errorf("expected %d problems, got %d in %v", len(test.problems), lines, err)
+			}
+		})
+	}
+}
+
+func TestRedacted(t *testing.T) {
+	cfg := validConfig()
+	cfg.Storage.ImageURLSecret = "image-secret"
+	cfg.Storage.LocalSecret = ""
+	cfg.Database.Host = "db.internal"
+
+	redacted := cfg.Redacted()
+
+	tests := []struct {
+		name string
+		got  string
+		want string
+	}{
+		{"secret is masked", redacted.Storage.ImageURLSecret, REDACTED},
+		{"empty secret stays empty", redacted.Storage.LocalSecret, ""},
+		{"other settings are kept", redacted.Database.Host, "db.internal"},
+		{"original is unchanged", cfg.Storage.ImageURLSecret, "image-secret"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if test.got != test.want {
+				t.Errorf("expected %q, got %q", test.want, test.got)
+			}
+		})
+	}
+
+	if output := cfg.String(); strings.Contains(output, "image-secret") {
+		t.Errorf("printed config contains a secret:\n%v", output)
+	}
+}
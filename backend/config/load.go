@@ -0,0 +1,204 @@
+package config
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/joho/godotenv"
+	"github.com/pelletier/go-toml/v2"
+	"gopkg.in/yaml.v3"
+)
+
+// Load builds the config from defaults, the config file, environment variables and flags,
+// in that order of precedence. The file is given with -config or CONFIG_FILE and is YAML
+// or TOML depending on its extension. A .env file in the working directory is loaded into
+// the environment first when present, without overriding variables that are already set.
+// Returns the arguments left after the flags, i.e. the command to run.
+func Load(args []string) (*Config, []string, error) {
+	if err := godotenv.Load(); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return nil, nil, fmt.Errorf("cannot load .env: %v", err)
+	}
+
+	cfg := Defaults()
+
+	flags := flag.NewFlagSet("movies-api", flag.ContinueOnError)
+	configFile := flags.String("config", os.Getenv("CONFIG_FILE"), "YAML or TOML config file (env CONFIG_FILE)")
+
+	// flags are only applied once the file and env are, so they keep the highest precedence
+	flagValues := map[string]string{}
+	eachSetting(cfg, func(s setting) {
+		name := s.field.Tag.Get("flag")
+		if name == "" {
+			return
+		}
+		usage := fmt.Sprintf("%v (env %v, default %v)", s.field.Tag.Get("usage"), s.field.Tag.Get("env"), formatValue(s.value))
+		flags.Func(name, usage, func(value string) error {
+			flagValues[name] = value
+			return nil
+		})
+	})
+
+	if err := flags.Parse(args); err != nil {
+		return nil, nil, err
+	}
+
+	if *configFile != "" {
+		if err := cfg.loadFile(*configFile); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	var problems []string
+	eachSetting(cfg, func(s setting) {
+		name := s.field.Tag.Get("env")
+		if value, ok := os.LookupEnv(name); ok && value != "" {
+			if err := setValue(s.value, value); err != nil {
+				problems = append(problems, fmt.Sprintf("env %v: %v", name, err))
+			}
+		}
+	})
+
+	eachSetting(cfg, func(s setting) {
+		name := s.field.Tag.Get("flag")
+		if value, ok := flagValues[name]; ok {
+			if err := setValue(s.value, value); err != nil {
+				problems = append(problems, fmt.Sprintf("flag -%v: %v", name, err))
+			}
+		}
+	})
+
+	if len(problems) > 0 {
+		return nil, nil, fmt.Errorf("invalid configuration:\n  %v", strings.Join(problems, "\n  "))
+	}
+
+	return cfg, flags.Args(), nil
+}
+
+// Apply a YAML or TOML file on top of the current settings. Unknown keys are an error so
+// a typo doesn't silently fall back to the default.
+func (c *Config) loadFile(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("cannot read config file: %v", err)
+	}
+
+	var document map[string]any
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		err = yaml.Unmarshal(data, &document)
+	case ".toml":
+		err = toml.Unmarshal(data, &document)
+	default:
+		return fmt.Errorf("config file %v must be .yaml, .yml or .toml", path)
+	}
+	if err != nil {
+		return fmt.Errorf("cannot parse config file %v: %v", path, err)
+	}
+
+	// flatten to dotted keys, e.g. {"database": {"port": 3306}} to "database.port"
+	values := map[string]any{}
+	var problems []string
+	for sectionKey, section := range document {
+		entries, ok := section.(map[string]any)
+		if !ok {
+			problems = append(problems, fmt.Sprintf("%v: must be a section", sectionKey))
+			continue
+		}
+		for key, value := range entries {
+			values[sectionKey+"."+key] = value
+		}
+	}
+
+	eachSetting(c, func(s setting) {
+		value, ok := values[s.key]
+		if !ok {
+			return
+		}
+		delete(values, s.key)
+
+		if err := setValue(s.value, fileValue(value)); err != nil {
+			problems = append(problems, fmt.Sprintf("%v: %v", s.key, err))
+		}
+	})
+
+	for key := range values {
+		problems = append(problems, fmt.Sprintf("%v: unknown setting", key))
+	}
+
+	if len(problems) > 0 {
+		sort.Strings(problems)
+		return fmt.Errorf("invalid config file %v:\n  %v", path, strings.Join(problems, "\n  "))
+	}
+	return nil
+}
+
+// Settings from a file go through the same parsing as env and flags, lists become comma separated
+func fileValue(value any) string {
+	if list, ok := value.([]any); ok {
+		entries := make([]string, len(list))
+		for i, entry := range list {
+			entries[i] = fmt.Sprint(entry)
+		}
+		return strings.Join(entries, ",")
+	}
+	return fmt.Sprint(value)
+}
+
+var durationType = reflect.TypeOf(time.Duration(0))
+
+// Parse a raw value into a setting according to its type
+func setValue(target reflect.Value, value string) error {
+	value = strings.TrimSpace(value)
+
+	switch {
+	case target.Type() == durationType:
+		duration, err := time.ParseDuration(value)
+		if err != nil {
+			return fmt.Errorf("%q is not a duration, e.g. 30s or 24h", value)
+		}
+		target.SetInt(int64(duration))
+	case target.Kind() == reflect.String:
+		target.SetString(value)
+	case target.Kind() == reflect.Int:
+		number, err := strconv.Atoi(value)
+		if err != nil {
+			return fmt.Errorf("%q is not a whole number", value)
+		}
+		target.SetInt(int64(number))
+	case target.Kind() == reflect.Float64:
+		number, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return fmt.Errorf("%q is not a number", value)
+		}
+		target.SetFloat(number)
+	case target.Kind() == reflect.Bool:
+		enabled, err := strconv.ParseBool(value)
+		if err != nil {
+			return fmt.Errorf("%q is not true or false", value)
+		}
+		target.SetBool(enabled)
+	default:
+		return fmt.Errorf("unsupported setting type %v", target.Type())
+	}
+
+	return nil
+}
+
+func formatValue(value reflect.Value) string {
+	if value.Type() == durationType {
+		return time.Duration(value.Int()).String()
+	}
+	if value.Kind() == reflect.String && value.String() == "" {
+		return `""`
+	}
+	return fmt.Sprint(value.Interface())
+}
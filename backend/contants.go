@@ -1,7 +1,29 @@
 package main
 
 const (
-	AWS_REGION  string = "ap-south-1"
-	MODEL_ID    string = "anthropic.claude-3-sonnet-20240229-v1:0"
-	BUCKET_NAME string = "movies-api-data"
+	CHAT_MAX_TOKENS     int32 = 500  // max tokens the model can return for a chat answer
+	CHAT_CONTEXT_TOKENS int   = 4000 // total token budget for system prompt, history and answer
+
+	MAX_CHAT_MESSAGE_LENGTH int = 2000 // characters in a single question, well within the context budget
 )
+
+type modelPrice struct {
+	InputPer1K  float64
+	OutputPer1K float64
+}
+
+// USD price per 1K tokens for the models we call
+var MODEL_PRICING = map[string]modelPrice{
+	"anthropic.claude-3-sonnet-20240229-v1:0": {InputPer1K: 0.003, OutputPer1K: 0.015},
+	"anthropic.claude-3-haiku-20240307-v1:0":  {InputPer1K: 0.00025, OutputPer1K: 0.00125},
+}
+
+// Controlled vocabulary the model has to pick genres from
+var GENRE_VOCABULARY = []string{
+	"Action", "Adventure", "Animation", "Biography", "Comedy", "Crime", "Documentary", "Drama",
+	"Family", "Fantasy", "History", "Horror", "Musical", "Mystery", "Romance", "Science Fiction",
+	"Sport", "Superhero", "Thriller", "War", "Western",
+}
+
+// Allowed content advisory ratings
+var CONTENT_ADVISORY_RATINGS = []string{"G", "PG", "PG-13", "R", "NC-17"}
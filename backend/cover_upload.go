@@ -0,0 +1,271 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	// direct uploads land here and are moved to the images prefix on confirm
+	UPLOAD_PREFIX string = "uploads"
+
+	COVER_UPLOAD_URL_EXPIRY time.Duration = 15 * time.Minute
+)
+
+// Extension of the staged upload for each allowed Content-Type
+var coverUploadExtensions = map[string]string{
+	"image/jpeg": ".jpg",
+	"image/png":  ".png",
+	"image/webp": ".webp",
+}
+
+// Handler for POST /api/movies/:movieId/cover/upload-url
+// Returns a url the client uploads the cover to directly, then calls the confirm endpoint with the key
+func createCoverUploadUrl(c *gin.Context) {
+	slog.DebugContext(c.Request.Context(), "Inside createCoverUploadUrl func")
+
+	contentType := c.PostForm("contentType")
+	size, err := strconv.ParseInt(c.PostForm("size"), 10, 64)
+
+	slog.DebugContext(c.Request.Context(), "FormData", "contentType", contentType, "size", c.PostForm("size"))
+
+	extension, ok := coverUploadExtensions[contentType]
+	if !ok {
+		respondError(c, invalidField("contentType", "must be image/jpeg, image/png or image/webp"))
+		return
+	}
+
+	if err != nil || size <= 0 || size > MAX_COVER_BYTES {
+		respondError(c, invalidField("size", fmt.Sprintf("must be between 1 and %d bytes", MAX_COVER_BYTES)))
+		return
+	}
+
+	movie, err := GetMovieById_DB(c.Request.Context(), c.Param("movieId"))
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+
+	uuid, err := generateUUID()
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+
+	key := fmt.Sprintf("%v/%d/%v%v", UPLOAD_PREFIX, movie.MovieId, uuid, extension)
+
+	upload, err := Blobs.PresignPut(c.Request.Context(), key, contentType, size, COVER_UPLOAD_URL_EXPIRY)
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+
+	data := map[string]any{
+		"key":    key,
+		"upload": upload,
+	}
+
+	c.JSON(http.StatusOK, response(http.StatusOK, true, "Cover upload url created", data))
+}
+
+// Handler for POST /api/movies/:movieId/cover/confirm
+// Checks the directly uploaded object, processes it like a form upload and attaches it to the movie
+func confirmCoverUpload(c *gin.Context) {
+	slog.DebugContext(c.Request.Context(), "Inside confirmCoverUpload func")
+
+	key := c.PostForm("key")
+	slog.DebugContext(c.Request.Context(), "FormData", "key", key)
+
+	movie, err := GetMovieById_DB(c.Request.Context(), c.Param("movieId"))
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+
+	// only keys handed out for this movie can be confirmed
+	prefix := fmt.Sprintf("%v/%d/", UPLOAD_PREFIX, movie.MovieId)
+	if !strings.HasPrefix(key, prefix) || path.Clean(key) != key {
+		respondError(c, invalidField("key", "is not an upload key for this movie"))
+		return
+	}
+
+	info, err := Blobs.Head(c.Request.Context(), key)
+	if errors.Is(err, ErrObjectNotFound) {
+		respondError(c, newError(ErrConflict, "uploaded cover not found, upload it before confirming"))
+		return
+	}
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+
+	// The staged object is never used as is, it's re-encoded. It's deleted once the cover is
+	// attached or rejected, after any other failure it's kept so the confirm can be retried
+	// and the uploads/ lifecycle rule removes what is never confirmed.
+	if info.Size > MAX_COVER_BYTES {
+		deleteCoverObjects(c.Request.Context(), []string{key})
+		respondError(c, newError(ErrValidation, fmt.Sprintf("cover image cannot be larger than %d MiB", MAX_COVER_BYTES>>20)))
+		return
+	}
+
+	image, _, err := getCoverImage(c.Request.Context(), key)
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+
+	// a fresh name, concurrent confirms of the same key must not store the same objects
+	uuid, err := generateUUID()
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+
+	cover, err := storeCoverImage(c.Request.Context(), image, uuid)
+	if err != nil {
+		if errors.Is(err, ErrValidation) {
+			deleteCoverObjects(c.Request.Context(), []string{key})
+		}
+		respondError(c, err)
+		return
+	}
+
+	if err := attachMovieCover(c.Request.Context(), movie, cover, llmUser(c)); err != nil {
+		respondError(c, err)
+		return
+	}
+
+	deleteCoverObjects(c.Request.Context(), []string{key})
+
+	updated, err := GetMovieById_DB(c.Request.Context(), strconv.Itoa(movie.MovieId))
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, response(http.StatusOK, true, "Cover uploaded successfully", updated))
+}
+
+// Handler for PUT /api/movies/:movieId/cover
+// Replaces the cover with the 'coverImage' form file, the previous cover is deleted
+func replaceMovieCover(c *gin.Context) {
+	slog.DebugContext(c.Request.Context(), "Inside replaceMovieCover func")
+
+	coverImage, _ := c.FormFile("coverImage")
+	if coverImage == nil {
+		respondError(c, invalidField("coverImage", "cannot be empty"))
+		return
+	}
+
+	slog.DebugContext(c.Request.Context(), "Movie coverImage file provided", "filename", coverImage.Filename)
+
+	movie, err := GetMovieById_DB(c.Request.Context(), c.Param("movieId"))
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+
+	uuid, err := generateUUID()
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+
+	cover, err := uploadCoverImage(c.Request.Context(), coverImage, uuid)
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+
+	if err := attachMovieCover(c.Request.Context(), movie, cover, llmUser(c)); err != nil {
+		respondError(c, err)
+		return
+	}
+
+	updated, err := GetMovieById_DB(c.Request.Context(), strconv.Itoa(movie.MovieId))
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, response(http.StatusOK, true, "Cover updated successfully", updated))
+}
+
+// Handler for DELETE /api/movies/:movieId/cover
+func deleteMovieCover(c *gin.Context) {
+	slog.DebugContext(c.Request.Context(), "Inside deleteMovieCover func")
+
+	movie, err := GetMovieById_DB(c.Request.Context(), c.Param("movieId"))
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+
+	if movie.CoverKey == nil || *movie.CoverKey == "" {
+		respondError(c, newError(ErrConflict, "movie has no cover image"))
+		return
+	}
+
+	if err := removeCover(c.Request.Context(), movie.MovieId); err != nil {
+		respondError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, response(http.StatusOK, true, "Cover deleted successfully", nil))
+}
+
+// Point a movie to a newly stored cover and describe it in the background
+func attachMovieCover(ctx context.Context, movie Movie, cover coverUpload, userId string) error {
+	if err := replaceCover(ctx, movie.MovieId, cover); err != nil {
+		return err
+	}
+
+	generateCoverAltTextAsync(ctx, movie, cover, userId)
+	return nil
+}
+
+// Attach a stored cover to a movie in DB, the alt text of the previous cover is cleared
+func UpdateMovieCover_DB(ctx context.Context, tx *sql.Tx, movieId int, cover coverUpload) error {
+	slog.DebugContext(ctx, "Inside UpdateMovieCover_DB func")
+
+	ctx, cancel := dbContext(ctx)
+	defer cancel()
+
+	variants, err := json.Marshal(cover.Variants)
+	if err != nil {
+		return fmt.Errorf("UpdateMovieCover_DB error: %v", err)
+	}
+
+	_, err = tx.ExecContext(ctx, "UPDATE movie_details SET coverKey=?, coverVariants=?, coverAltText=NULL, coverDescription=NULL WHERE movieId = ?", cover.Key, string(variants), movieId)
+	if err != nil {
+		return fmt.Errorf("UpdateMovieCover_DB error: %v", err)
+	}
+
+	return nil
+}
+
+// Remove the cover of a movie in DB
+func ClearMovieCover_DB(ctx context.Context, tx *sql.Tx, movieId int) error {
+	slog.DebugContext(ctx, "Inside ClearMovieCover_DB func")
+
+	ctx, cancel := dbContext(ctx)
+	defer cancel()
+
+	_, err := tx.ExecContext(ctx, "UPDATE movie_details SET coverKey=NULL, coverVariants=NULL, coverAltText=NULL, coverDescription=NULL WHERE movieId = ?", movieId)
+	if err != nil {
+		return fmt.Errorf("ClearMovieCover_DB error: %v", err)
+	}
+
+	return nil
+}
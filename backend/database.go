@@ -1,53 +1,149 @@
 package main
 
 import (
+	"context"
 	"database/sql"
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
 	"fmt"
-	"log"
-	"os"
+	"log/slog"
+	"net"
+	"strconv"
 	"strings"
 
+	"github.com/XSAM/otelsql"
 	"github.com/go-sql-driver/mysql"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
 )
 
 var db *sql.DB
 
-func DBConnectAndPing(db_password string) error {
-	log.Print("Inside DBConnectAndPing func")
+// Columns selected for a Movie, in the order scanMovie reads them
+const movieColumns = "movieId, title, releaseYear, genre, coverKey, coverVariants, generatedSummary, contentAdvisory, coverAltText, coverDescription, summaryModelId"
+
+type rowScanner interface {
+	Scan(dest ...any) error
+}
+
+// The DB or a transaction, for statements that run either way
+type execer interface {
+	ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error)
+}
+
+func scanMovie(row rowScanner, movie *Movie) error {
+	var variants sql.NullString
+	if err := row.Scan(&movie.MovieId, &movie.Title, &movie.ReleaseYear, &movie.Genre, &movie.CoverKey, &variants, &movie.GeneratedSummary, &movie.ContentAdvisory, &movie.CoverAltText, &movie.CoverDescription, &movie.SummaryModelId); err != nil {
+		return err
+	}
+
+	if movie.CoverKey != nil && *movie.CoverKey != "" {
+		coverUrl := coverPublicURL(*movie.CoverKey)
+		movie.CoverUrl = &coverUrl
+	}
+
+	if variants.Valid {
+		if err := json.Unmarshal([]byte(variants.String), &movie.CoverVariantKeys); err != nil {
+			return err
+		}
+
+		movie.CoverVariants = map[string]CoverVariant{}
+		for name, variant := range movie.CoverVariantKeys {
+			variant.Jpeg, variant.Webp = coverPublicURL(variant.Jpeg), coverPublicURL(variant.Webp)
+			movie.CoverVariants[name] = variant
+		}
+	}
+
+	return nil
+}
+
+// Bound a single DB operation by the database.queryTimeout setting (DB_QUERY_TIMEOUT)
+func dbContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	return context.WithTimeout(ctx, appConfig.Database.QueryTimeout)
+}
+
+// MySQL error for a rejected user or password
+const ER_ACCESS_DENIED_ERROR uint16 = 1045
+
+func DBConnectAndPing() error {
+	slog.Debug("Inside DBConnectAndPing func")
+
+	database := appConfig.Database
 
 	// Capture connection properties
-	cfg := mysql.Config{
-		User: os.Getenv("DB_USER"),
-		// Passwd: os.Getenv("DB_PASS"),
-		Passwd: db_password,
-		Net:    "tcp",
-		Addr:   "127.0.0.1:3306",
-		DBName: os.Getenv("DB_NAME"),
+	cfg := mysql.NewConfig()
+	cfg.User = database.User
+	cfg.Net = "tcp"
+	cfg.Addr = net.JoinHostPort(database.Host, strconv.Itoa(database.Port))
+	cfg.DBName = database.Name
+	// scan DATETIME/TIMESTAMP columns into time.Time
+	cfg.ParseTime = true
+
+	// the password is looked up for every new connection, so a rotated password is used
+	// by new connections without a restart
+	err := cfg.Apply(mysql.BeforeConnect(func(ctx context.Context, cfg *mysql.Config) error {
+		password, err := Secrets.GetField(ctx, database.PasswordSecret, database.SecretKey)
+		if err != nil {
+			return fmt.Errorf("DB password error: %v", err)
+		}
+		cfg.Passwd = password
+		return nil
+	}))
+	if err != nil {
+		return fmt.Errorf("DB Connection error: %v", err)
 	}
 
-	// Get a database handle.
-	var err error
-	db, err = sql.Open("mysql", cfg.FormatDSN())
+	connector, err := mysql.NewConnector(cfg)
 	if err != nil {
 		return fmt.Errorf("DB Connection error: %v", err)
 	}
 
+	// Get a database handle.
+	// a span per query, with the statement but not its arguments
+	db = otelsql.OpenDB(rotatingConnector{Connector: connector, secret: database.PasswordSecret},
+		otelsql.WithAttributes(semconv.DBSystemMySQL),
+		otelsql.WithSpanOptions(otelsql.SpanOptions{DisableErrSkip: true, OmitConnResetSession: true}),
+	)
+	registerDBMetrics(db, database.Name)
+
 	// check if db is connected
 	if err := db.Ping(); err != nil {
 		return fmt.Errorf("DB Connection error: %v", err)
 	}
-	log.Print("DB Connected")
+	slog.Info("DB connected", "host", appConfig.Database.Host, "database", appConfig.Database.Name)
 	return nil
 
 }
 
+// rotatingConnector connects again with a freshly fetched password when MySQL rejects the
+// cached one, e.g. right after the secret was rotated
+type rotatingConnector struct {
+	driver.Connector
+	secret string
+}
+
+func (c rotatingConnector) Connect(ctx context.Context) (driver.Conn, error) {
+	conn, err := c.Connector.Connect(ctx)
+
+	var mysqlErr *mysql.MySQLError
+	if errors.As(err, &mysqlErr) && mysqlErr.Number == ER_ACCESS_DENIED_ERROR && Secrets.Invalidate(c.secret) {
+		slog.WarnContext(ctx, "DB rejected the password, fetching the secret again", "secret", c.secret)
+		conn, err = c.Connector.Connect(ctx)
+	}
+
+	return conn, err
+}
+
 // Get list of all movies from DB
-func GetAllMovies_DB() ([]Movie, error) {
-	log.Print("Inside GetAllMovies_DB func")
+func GetAllMovies_DB(ctx context.Context) ([]Movie, error) {
+	slog.DebugContext(ctx, "Inside GetAllMovies_DB func")
+
+	ctx, cancel := dbContext(ctx)
+	defer cancel()
 
 	var movies []Movie
 
-	rows, err := db.Query("SELECT * FROM movie_details")
+	rows, err := db.QueryContext(ctx, "SELECT "+movieColumns+" FROM movie_details")
 	if err != nil {
 		return nil, fmt.Errorf("GetAllMovies_DB error: %v", err)
 	}
@@ -57,7 +153,7 @@ func GetAllMovies_DB() ([]Movie, error) {
 	for rows.Next() {
 		var movie Movie
 
-		if err := rows.Scan(&movie.MovieId, &movie.Title, &movie.ReleaseYear, &movie.Genre, &movie.CoverUrl, &movie.GeneratedSummary); err != nil {
+		if err := scanMovie(rows, &movie); err != nil {
 			return nil, fmt.Errorf("GetAllMovies_DB error: %v", err)
 		}
 
@@ -72,12 +168,15 @@ func GetAllMovies_DB() ([]Movie, error) {
 }
 
 // Get list of all movies by year from DB
-func GetMoviesByYear_DB(year string) ([]Movie, error) {
-	log.Print("Inside GetMoviesByYear_DB func")
+func GetMoviesByYear_DB(ctx context.Context, year string) ([]Movie, error) {
+	slog.DebugContext(ctx, "Inside GetMoviesByYear_DB func")
+
+	ctx, cancel := dbContext(ctx)
+	defer cancel()
 
 	var movies []Movie
 
-	rows, err := db.Query("SELECT * FROM movie_details WHERE releaseYear = ?", year)
+	rows, err := db.QueryContext(ctx, "SELECT "+movieColumns+" FROM movie_details WHERE releaseYear = ?", year)
 	if err != nil {
 		return nil, fmt.Errorf("GetMoviesByYear_DB error: %v", err)
 	}
@@ -87,7 +186,7 @@ func GetMoviesByYear_DB(year string) ([]Movie, error) {
 	for rows.Next() {
 		var movie Movie
 
-		if err := rows.Scan(&movie.MovieId, &movie.Title, &movie.ReleaseYear, &movie.Genre, &movie.CoverUrl, &movie.GeneratedSummary); err != nil {
+		if err := scanMovie(rows, &movie); err != nil {
 			return nil, fmt.Errorf("GetMoviesByYear_DB error: %v", err)
 		}
 
@@ -102,16 +201,19 @@ func GetMoviesByYear_DB(year string) ([]Movie, error) {
 }
 
 // Get a single movie by movieId from DB
-func GetMovieById_DB(movieId string) (Movie, error) {
-	log.Print("Inside GetMovieById_DB func")
+func GetMovieById_DB(ctx context.Context, movieId string) (Movie, error) {
+	slog.DebugContext(ctx, "Inside GetMovieById_DB func")
+
+	ctx, cancel := dbContext(ctx)
+	defer cancel()
 
 	var movie Movie
-	row := db.QueryRow("SELECT * FROM movie_details WHERE movieId = ?", movieId)
+	row := db.QueryRowContext(ctx, "SELECT "+movieColumns+" FROM movie_details WHERE movieId = ?", movieId)
 
-	if err := row.Scan(&movie.MovieId, &movie.Title, &movie.ReleaseYear, &movie.Genre, &movie.CoverUrl, &movie.GeneratedSummary); err != nil {
+	if err := scanMovie(row, &movie); err != nil {
 		if err == sql.ErrNoRows {
-			log.Printf("GetMovieById_DB error: %v", err)
-			return movie, fmt.Errorf("No movie found with given movieId")
+			slog.DebugContext(ctx, "GetMovieById_DB error", "error", err)
+			return movie, newError(ErrNotFound, "No movie found with given movieId")
 		}
 		return movie, fmt.Errorf("GetMovieById_DB error: %v", err)
 	}
@@ -120,102 +222,271 @@ func GetMovieById_DB(movieId string) (Movie, error) {
 }
 
 // Get movie summary for a specific movie from DB if not then generate a summary and then save it in DB
-func GetMovieSummary_DB(movieId string) (string, error) {
-	log.Print("Inside GetMovieSummary_DB func")
+func GetMovieSummary_DB(ctx context.Context, movieId string, userId string) (Movie, error) {
+	slog.DebugContext(ctx, "Inside GetMovieSummary_DB func")
 
-	var movie Movie
-	row := db.QueryRow("SELECT * FROM movie_details WHERE movieId = ?", movieId)
-
-	if err := row.Scan(&movie.MovieId, &movie.Title, &movie.ReleaseYear, &movie.Genre, &movie.CoverUrl, &movie.GeneratedSummary); err != nil {
-		if err == sql.ErrNoRows {
-			log.Printf("GetMovieById_DB error: %v", err)
-			return "", fmt.Errorf("No movie found with given movieId")
-		}
-		return "", fmt.Errorf("GetMovieById_DB error: %v", err)
+	// no query timeout around the whole function, generating the summary takes longer
+	movie, err := GetMovieById_DB(ctx, movieId)
+	if err != nil {
+		return movie, err
 	}
 
 	if movie.GeneratedSummary == nil || *movie.GeneratedSummary == "" {
-		log.Print("No summary available. Generate a summary.")
+		// don't generate again while an earlier summary waits for an editor
+		pending, err := HasPendingSummaryReview_DB(ctx, movie.MovieId)
+		if err != nil {
+			return movie, err
+		}
+		if pending {
+			return movie, ErrSummaryPendingReview
+		}
+
+		slog.InfoContext(ctx, "No summary available, generating one", "movieId", movie.MovieId)
+		metrics.summaryCache.WithLabelValues("miss").Inc()
 
 		// Call the bedrock service to generate the movie summary
-		movieSummary, err := GenerateMovieSummary(movie)
+		result, err := GenerateMovieSummary(ctx, movie, userId)
 		if err != nil {
-			log.Print(err)
-			return "", err
+			slog.ErrorContext(ctx, "Error generating summary", "movieId", movie.MovieId, "error", err)
+			return movie, err
+		}
+
+		// Flagged summaries are quarantined instead of being served
+		if reasons := validateSummary(result.Text); len(reasons) > 0 {
+			slog.WarnContext(ctx, "Generated summary flagged", "movieId", movie.MovieId, "reasons", reasons)
+			if err := AddSummaryReview_DB(ctx, movie.MovieId, result.Text, result.ModelId, reasons); err != nil {
+				slog.ErrorContext(ctx, "Error queueing summary for review", "movieId", movie.MovieId, "error", err)
+				return movie, err
+			}
+			return movie, ErrSummaryPendingReview
 		}
 
 		// Save the summary for next time fetch for the movie
-		if err := UpdateMovieSummary_DB(movie.MovieId, movieSummary); err != nil {
-			log.Print(err)
-			return "", err
+		if err := UpdateMovieSummary_DB(ctx, movie.MovieId, result.Text, result.ModelId); err != nil {
+			slog.ErrorContext(ctx, "Error saving summary", "movieId", movie.MovieId, "error", err)
+			return movie, err
 		}
 
-		return movieSummary, nil
+		movie.GeneratedSummary = &result.Text
+		movie.SummaryModelId = &result.ModelId
+		return movie, nil
 	}
 
-	return *movie.GeneratedSummary, nil
+	metrics.summaryCache.WithLabelValues("hit").Inc()
+	return movie, nil
 }
 
 // Update the movie summary based on movieId in DB
-func UpdateMovieSummary_DB(movieId int, summary string) error {
-	log.Print("Inside UpdateMovieSummary_DB func")
+func UpdateMovieSummary_DB(ctx context.Context, movieId int, summary string, modelId string) error {
+	slog.DebugContext(ctx, "Inside UpdateMovieSummary_DB func")
+
+	ctx, cancel := dbContext(ctx)
+	defer cancel()
 
-	_, err := db.Exec("UPDATE movie_details SET generatedSummary=? WHERE movieId=?", summary, movieId)
+	_, err := db.ExecContext(ctx, "UPDATE movie_details SET generatedSummary=?, summaryModelId=? WHERE movieId=?", summary, modelId, movieId)
 
 	if err != nil {
 		return fmt.Errorf("UpdateMovieSummary_DB error: %v", err)
 	}
 
-	log.Print("Movie summary updated")
+	slog.InfoContext(ctx, "Movie summary updated", "movieId", movieId)
 	return nil
 }
 
-// Get the movie details by movie title from DB
-func GetMovieByTitle_DB(title string) (Movie, error) {
+const (
+	// MySQL error number of a unique index violation
+	MYSQL_DUPLICATE_ENTRY uint16 = 1062
 
-	var movie Movie
-	row := db.QueryRow("SELECT * FROM movie_details WHERE LOWER(TRIM(title)) = ?", strings.TrimSpace(strings.ToLower(title)))
+	// Unique index on the normalized title and release year, from migration 004
+	UNIQUE_TITLE_YEAR_INDEX string = "uq_movie_details_title_year"
+)
 
-	if err := row.Scan(&movie.MovieId, &movie.Title, &movie.ReleaseYear, &movie.Genre, &movie.CoverUrl, &movie.GeneratedSummary); err != nil {
-		if err == sql.ErrNoRows {
-			log.Printf("GetMovieByTitle_DB error: %v", err)
-			return Movie{}, fmt.Errorf("No movie found with given movie title")
+// Wrapped by the conflict returned when another movie has the same title and release year
+var ErrDuplicateMovie = errors.New("movie with same title and release year already exists")
+
+// Translate a violation of the unique title and release year index into a conflict that
+// references the movie already having them, nil for any other error, including violations
+// of other unique indexes.
+//
+// normalizedTitle is LOWER(TRIM(title)) and doesn't collapse inner whitespace like
+// sanitizeField does. Every title the API stores is sanitized first, so the two only
+// differ for rows written around the API, e.g. by hand in SQL.
+func DuplicateMovieConflict_DB(ctx context.Context, tx *sql.Tx, movie Movie, err error) error {
+	var mysqlErr *mysql.MySQLError
+	if !errors.As(err, &mysqlErr) || mysqlErr.Number != MYSQL_DUPLICATE_ENTRY || !violatesIndex(mysqlErr, UNIQUE_TITLE_YEAR_INDEX) {
+		return nil
+	}
+
+	message := fmt.Sprintf("a movie titled %q from %d already exists", movie.Title, movie.ReleaseYear)
+
+	// same normalization as the normalizedTitle column
+	var existingId int
+	if err := tx.QueryRowContext(ctx, "SELECT movieId FROM movie_details WHERE normalizedTitle = LOWER(TRIM(?)) AND releaseYear = ?", movie.Title, movie.ReleaseYear).Scan(&existingId); err != nil {
+		slog.WarnContext(ctx, "Error looking up the existing movie of a duplicate", "error", err)
+		return wrapError(ErrConflict, message, ErrDuplicateMovie)
+	}
+
+	conflict := wrapError(ErrConflict, fmt.Sprintf("%v with movieId %d", message, existingId), ErrDuplicateMovie)
+	conflict.Existing = fmt.Sprintf("/api/movies/%d", existingId)
+	return conflict
+}
+
+// Check the index named by a duplicate entry error, "... for key 'uq_x'" and, since MySQL
+// 8.0.19, "... for key 'table.uq_x'"
+func violatesIndex(mysqlErr *mysql.MySQLError, index string) bool {
+	return strings.HasSuffix(mysqlErr.Message, "'"+index+"'") || strings.HasSuffix(mysqlErr.Message, "."+index+"'")
+}
+
+// MovieTitleConflict is a movie the unique title migration renamed because an older movie
+// has the same title and release year. The row goes away once the movie is deleted.
+type MovieTitleConflict struct {
+	MovieId       int    `json:"movieId"`
+	KeptMovieId   int    `json:"keptMovieId"`
+	OriginalTitle string `json:"originalTitle"`
+	ReleaseYear   uint16 `json:"releaseYear"`
+}
+
+// Get the duplicates found by the unique title migration that are still in the DB
+func GetMovieTitleConflicts_DB(ctx context.Context) ([]MovieTitleConflict, error) {
+	slog.DebugContext(ctx, "Inside GetMovieTitleConflicts_DB func")
+
+	ctx, cancel := dbContext(ctx)
+	defer cancel()
+
+	rows, err := db.QueryContext(ctx, "SELECT movieId, keptMovieId, originalTitle, releaseYear FROM movie_title_conflicts ORDER BY keptMovieId, movieId")
+	if err != nil {
+		return nil, fmt.Errorf("GetMovieTitleConflicts_DB error: %v", err)
+	}
+	defer rows.Close()
+
+	conflicts := []MovieTitleConflict{}
+	for rows.Next() {
+		var conflict MovieTitleConflict
+		if err := rows.Scan(&conflict.MovieId, &conflict.KeptMovieId, &conflict.OriginalTitle, &conflict.ReleaseYear); err != nil {
+			return nil, fmt.Errorf("GetMovieTitleConflicts_DB error: %v", err)
 		}
-		return Movie{}, fmt.Errorf("GetMovieByTitle_DB error: %v", err)
+		conflicts = append(conflicts, conflict)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("GetMovieTitleConflicts_DB error: %v", err)
 	}
 
-	return movie, nil
+	return conflicts, nil
 }
 
-// Add the movie in the DB
-func AddMovie_DB(movie Movie) error {
-	log.Print("Inside AddMovie_DB func")
+// Get the object keys of a movie's cover, and optionally its gallery, locking the movie row
+func GetMovieObjectKeys_DB(ctx context.Context, tx *sql.Tx, movieId int, withGallery bool) ([]string, error) {
+	slog.DebugContext(ctx, "Inside GetMovieObjectKeys_DB func")
+
+	ctx, cancel := dbContext(ctx)
+	defer cancel()
+
+	var coverKey, coverVariants sql.NullString
+	err := tx.QueryRowContext(ctx, "SELECT coverKey, coverVariants FROM movie_details WHERE movieId = ? FOR UPDATE", movieId).Scan(&coverKey, &coverVariants)
+	if err == sql.ErrNoRows {
+		return nil, newError(ErrNotFound, "No movie found with given movieId")
+	}
+	if err != nil {
+		return nil, fmt.Errorf("GetMovieObjectKeys_DB error: %v", err)
+	}
+
+	var keys []string
+	if coverKey.Valid && coverKey.String != "" {
+		var variants map[string]CoverVariant
+		if coverVariants.Valid {
+			if err := json.Unmarshal([]byte(coverVariants.String), &variants); err != nil {
+				return nil, fmt.Errorf("GetMovieObjectKeys_DB error: %v", err)
+			}
+		}
+		keys = append(keys, coverObjectKeys(coverKey.String, variants)...)
+	}
+
+	if !withGallery {
+		return keys, nil
+	}
 
+	rows, err := tx.QueryContext(ctx, "SELECT imageKey, variants FROM movie_images WHERE movieId = ? FOR UPDATE", movieId)
+	if err != nil {
+		return nil, fmt.Errorf("GetMovieObjectKeys_DB error: %v", err)
+	}
+
+	defer rows.Close()
+
+	for rows.Next() {
+		var imageKey, imageVariants string
+		if err := rows.Scan(&imageKey, &imageVariants); err != nil {
+			return nil, fmt.Errorf("GetMovieObjectKeys_DB error: %v", err)
+		}
+
+		var variants map[string]CoverVariant
+		if err := json.Unmarshal([]byte(imageVariants), &variants); err != nil {
+			return nil, fmt.Errorf("GetMovieObjectKeys_DB error: %v", err)
+		}
+		keys = append(keys, coverObjectKeys(imageKey, variants)...)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("GetMovieObjectKeys_DB error: %v", err)
+	}
+
+	return keys, nil
+}
+
+// Add the movie in the DB and return the new movieId
+func AddMovie_DB(ctx context.Context, tx *sql.Tx, movie Movie) (int, error) {
+	slog.DebugContext(ctx, "Inside AddMovie_DB func")
+
+	ctx, cancel := dbContext(ctx)
+	defer cancel()
+
+	var result sql.Result
 	var err error
-	if movie.CoverUrl == nil || *movie.CoverUrl == "" {
-		_, err = db.Exec("INSERT INTO movie_details (title, releaseYear, genre) VALUES (?,?,?)", movie.Title, movie.ReleaseYear, movie.Genre)
+	if movie.CoverKey == nil || *movie.CoverKey == "" {
+		result, err = tx.ExecContext(ctx, "INSERT INTO movie_details (title, releaseYear, genre) VALUES (?,?,?)", movie.Title, movie.ReleaseYear, movie.Genre)
 	} else {
-		_, err = db.Exec("INSERT INTO movie_details (title, releaseYear, genre, coverUrl) VALUES (?,?,?,?)", movie.Title, movie.ReleaseYear, movie.Genre, movie.CoverUrl)
+		variants, jsonErr := json.Marshal(movie.CoverVariantKeys)
+		if jsonErr != nil {
+			return 0, fmt.Errorf("AddMovie_DB error: %v", jsonErr)
+		}
+		result, err = tx.ExecContext(ctx, "INSERT INTO movie_details (title, releaseYear, genre, coverKey, coverVariants) VALUES (?,?,?,?,?)", movie.Title, movie.ReleaseYear, movie.Genre, movie.CoverKey, string(variants))
 	}
 
 	if err != nil {
-		return fmt.Errorf("AddMovie_DB error: %v", err)
+		if conflict := DuplicateMovieConflict_DB(ctx, tx, movie, err); conflict != nil {
+			return 0, conflict
+		}
+		return 0, fmt.Errorf("AddMovie_DB error: %v", err)
 	}
 
-	return nil
+	movieId, err := result.LastInsertId()
+	if err != nil {
+		return 0, fmt.Errorf("AddMovie_DB error: %v", err)
+	}
+
+	return int(movieId), nil
 }
 
 // Update the movie by using the movieId in DB
-func UpdateMovieById_DB(movieId string, movie Movie) error {
-	log.Print("Inside UpdateMovieById_DB func")
+func UpdateMovieById_DB(ctx context.Context, tx *sql.Tx, movieId int, movie Movie) error {
+	slog.DebugContext(ctx, "Inside UpdateMovieById_DB func")
+
+	ctx, cancel := dbContext(ctx)
+	defer cancel()
 
 	var err error
-	if movie.CoverUrl == nil || *movie.CoverUrl == "" {
-		_, err = db.Exec("UPDATE movie_details SET title=?, releaseYear=?, genre=? WHERE movieId = ?", movie.Title, movie.ReleaseYear, movie.Genre, movieId)
+	if movie.CoverKey == nil || *movie.CoverKey == "" {
+		_, err = tx.ExecContext(ctx, "UPDATE movie_details SET title=?, releaseYear=?, genre=? WHERE movieId = ?", movie.Title, movie.ReleaseYear, movie.Genre, movieId)
 	} else {
-		_, err = db.Exec("UPDATE movie_details SET title=?, releaseYear=?, genre=?, coverUrl=? WHERE movieId = ?", movie.Title, movie.ReleaseYear, movie.Genre, movie.CoverUrl, movieId)
+		variants, jsonErr := json.Marshal(movie.CoverVariantKeys)
+		if jsonErr != nil {
+			return fmt.Errorf("UpdateMovieById_DB error: %v", jsonErr)
+		}
+		_, err = tx.ExecContext(ctx, "UPDATE movie_details SET title=?, releaseYear=?, genre=?, coverKey=?, coverVariants=?, coverAltText=NULL, coverDescription=NULL WHERE movieId = ?", movie.Title, movie.ReleaseYear, movie.Genre, movie.CoverKey, string(variants), movieId)
 	}
 	if err != nil {
+		if conflict := DuplicateMovieConflict_DB(ctx, tx, movie, err); conflict != nil {
+			return conflict
+		}
 		return fmt.Errorf("UpdateMovieById_DB error: %v", err)
 	}
 
@@ -223,10 +494,13 @@ func UpdateMovieById_DB(movieId string, movie Movie) error {
 }
 
 // Delete a movie by using movieId from DB
-func DeleteMovieById_DB(movieId string) error {
-	log.Print("Inside DeleteMovieById_DB func")
+func DeleteMovieById_DB(ctx context.Context, tx *sql.Tx, movieId int) error {
+	slog.DebugContext(ctx, "Inside DeleteMovieById_DB func")
+
+	ctx, cancel := dbContext(ctx)
+	defer cancel()
 
-	_, err := db.Exec("DELETE FROM movie_details WHERE movieId = ?", movieId)
+	_, err := tx.ExecContext(ctx, "DELETE FROM movie_details WHERE movieId = ?", movieId)
 	if err != nil {
 		return fmt.Errorf("DeleteMovieById_DB error: %v", err)
 	}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Kinds of failure. Errors returned to handlers wrap one of them, which decides the HTTP
+// status in respondError. Anything else is an internal error and its text is never sent.
+var (
+	ErrNotFound    = errors.New("not found")
+	ErrConflict    = errors.New("conflict")
+	ErrValidation  = errors.New("validation failed")
+	ErrForbidden   = errors.New("forbidden")
+	ErrUpstream    = errors.New("upstream service failed")
+	ErrUnavailable = errors.New("temporarily unavailable")
+)
+
+var errorKinds = []struct {
+	kind   error
+	status int
+	code   string
+}{
+	{ErrNotFound, http.StatusNotFound, "not_found"},
+	{ErrConflict, http.StatusConflict, "conflict"},
+	{ErrValidation, http.StatusUnprocessableEntity, "validation"},
+	{ErrForbidden, http.StatusForbidden, "forbidden"},
+	{ErrUpstream, http.StatusBadGateway, "upstream"},
+	{ErrUnavailable, http.StatusServiceUnavailable, "unavailable"},
+}
+
+const PROBLEM_CONTENT_TYPE string = "application/problem+json"
+
+// AppError is an error of a known kind with a message that is safe to show to clients.
+// The cause is only logged.
+type AppError struct {
+	Kind    error
+	Message string
+	Fields  []FieldError
+	Err     error
+	// path of the resource a conflict is with, e.g. the movie that already has a title
+	Existing string
+}
+
+// FieldError is a single invalid input field
+type FieldError struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+func (e *AppError) Error() string {
+	if e.Err != nil {
+		return fmt.Sprintf("%v: %v", e.Message, e.Err)
+	}
+	return e.Message
+}
+
+func (e *AppError) Unwrap() []error {
+	if e.Err != nil {
+		return []error{e.Kind, e.Err}
+	}
+	return []error{e.Kind}
+}
+
+func newError(kind error, message string) *AppError {
+	return &AppError{Kind: kind, Message: message}
+}
+
+// An error of the given kind caused by err, e.g. a failed S3 call as ErrUpstream
+func wrapError(kind error, message string, err error) *AppError {
+	return &AppError{Kind: kind, Message: message, Err: err}
+}
+
+// A validation error with the details of every invalid field
+func validationError(message string, fields ...FieldError) *AppError {
+	return &AppError{Kind: ErrValidation, Message: message, Fields: fields}
+}
+
+// A validation error for a single field, e.g. invalidField("title", "cannot be empty")
+func invalidField(field string, message string) *AppError {
+	return validationError(fmt.Sprintf("'%v' %v", field, message), FieldError{Field: field, Message: message})
+}
+
+// Problem is an RFC 7807 problem details body
+type Problem struct {
+	Type      string       `json:"type"`
+	Title     string       `json:"title"`
+	Status    int          `json:"status"`
+	Detail    string       `json:"detail"`
+	Instance  string       `json:"instance,omitempty"`
+	Code      string       `json:"code"`
+	RequestId string       `json:"requestId,omitempty"`
+	Errors    []FieldError `json:"errors,omitempty"`
+	Existing  string       `json:"existing,omitempty"`
+}
+
+// Problem for an error, internal errors get a generic detail so driver and AWS error
+// strings don't leak to clients
+func problemFor(err error) Problem {
+	problem := Problem{Status: http.StatusInternalServerError, Code: "internal", Detail: "Internal server error"}
+
+	for _, kind := range errorKinds {
+		if errors.Is(err, kind.kind) {
+			problem.Status, problem.Code = kind.status, kind.code
+			break
+		}
+	}
+
+	var appErr *AppError
+	if problem.Code != "internal" && errors.As(err, &appErr) {
+		problem.Detail = appErr.Message
+		problem.Errors = appErr.Fields
+		problem.Existing = appErr.Existing
+	}
+
+	problem.Type = "about:blank"
+	problem.Title = http.StatusText(problem.Status)
+	return problem
+}
+
+// Reply with the problem details of err. The error itself is attached to the request, so
+// the access log has it, including the cause that isn't sent.
+func respondError(c *gin.Context, err error) {
+	c.Error(err)
+	respondProblem(c, problemFor(err))
+}
+
+func respondProblem(c *gin.Context, problem Problem) {
+	problem.Instance = c.Request.URL.Path
+	problem.RequestId = requestIdFrom(c.Request.Context())
+
+	c.Header("Content-Type", PROBLEM_CONTENT_TYPE)
+	c.AbortWithStatusJSON(problem.Status, problem)
+}
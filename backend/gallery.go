@@ -0,0 +1,410 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	IMAGE_KIND_POSTER   string = "poster"
+	IMAGE_KIND_BACKDROP string = "backdrop"
+	IMAGE_KIND_STILL    string = "still"
+)
+
+var IMAGE_KINDS = []string{IMAGE_KIND_POSTER, IMAGE_KIND_BACKDROP, IMAGE_KIND_STILL}
+
+// MovieImage is an image in a movie's gallery. The primary image is the one clients
+// show first, at most one per movie.
+type MovieImage struct {
+	ImageId     int                     `json:"imageId"`
+	MovieId     int                     `json:"movieId"`
+	Kind        string                  `json:"kind"`
+	ImageKey    string                  `json:"imageKey"`
+	ImageUrl    string                  `json:"imageUrl"` // computed from ImageKey, not stored
+	Variants    map[string]CoverVariant `json:"variants"`
+	VariantKeys map[string]CoverVariant `json:"-"`
+	Position    int                     `json:"position"`
+	IsPrimary   bool                    `json:"isPrimary"`
+	CreatedAt   time.Time               `json:"createdAt"`
+}
+
+// Handler for GET /api/movies/:movieId/images
+func getMovieImages(c *gin.Context) {
+	slog.DebugContext(c.Request.Context(), "Inside getMovieImages func")
+
+	movie, err := GetMovieById_DB(c.Request.Context(), c.Param("movieId"))
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+
+	images, err := GetMovieImages_DB(c.Request.Context(), movie.MovieId)
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, response(http.StatusOK, true, "Movie images fetched", images))
+}
+
+// Handler for POST /api/movies/:movieId/images
+// Form fields: 'image' file, 'kind' (poster, backdrop or still) and optional 'primary=true'.
+// The image is added at the end of the gallery, the first image of a movie becomes primary.
+func addMovieImage(c *gin.Context) {
+	slog.DebugContext(c.Request.Context(), "Inside addMovieImage func")
+
+	kind := c.PostForm("kind")
+	primary := c.PostForm("primary") == "true"
+
+	slog.DebugContext(c.Request.Context(), "FormData", "kind", kind, "primary", primary)
+
+	if !slices.Contains(IMAGE_KINDS, kind) {
+		respondError(c, invalidField("kind", fmt.Sprintf("must be one of %v", strings.Join(IMAGE_KINDS, ", "))))
+		return
+	}
+
+	file, _ := c.FormFile("image")
+	if file == nil {
+		respondError(c, invalidField("image", "cannot be empty"))
+		return
+	}
+
+	movie, err := GetMovieById_DB(c.Request.Context(), c.Param("movieId"))
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+
+	uuid, err := generateUUID()
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+
+	upload, err := uploadCoverImage(c.Request.Context(), file, uuid)
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+
+	image, err := AddMovieImage_DB(c.Request.Context(), movie.MovieId, kind, upload, primary)
+	if err != nil {
+		deleteCoverObjects(c.Request.Context(), coverObjectKeys(upload.Key, upload.Variants))
+		respondError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, response(http.StatusOK, true, "Movie image added", image))
+}
+
+// Handler for PUT /api/movies/:movieId/images/order
+// Form field 'imageIds' lists every image of the movie, comma separated, in the new order
+func reorderMovieImages(c *gin.Context) {
+	slog.DebugContext(c.Request.Context(), "Inside reorderMovieImages func")
+
+	slog.DebugContext(c.Request.Context(), "FormData", "imageIds", c.PostForm("imageIds"))
+
+	var imageIds []int
+	for _, value := range strings.Split(c.PostForm("imageIds"), ",") {
+		imageId, err := strconv.Atoi(strings.TrimSpace(value))
+		if err != nil {
+			respondError(c, invalidField("imageIds", "must be a comma separated list of image ids"))
+			return
+		}
+		imageIds = append(imageIds, imageId)
+	}
+
+	movie, err := GetMovieById_DB(c.Request.Context(), c.Param("movieId"))
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+
+	if err := ReorderMovieImages_DB(c.Request.Context(), movie.MovieId, imageIds); err != nil {
+		respondError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, response(http.StatusOK, true, "Movie images reordered", nil))
+}
+
+// Handler for POST /api/movies/:movieId/images/:imageId/primary
+func setPrimaryMovieImage(c *gin.Context) {
+	slog.DebugContext(c.Request.Context(), "Inside setPrimaryMovieImage func")
+
+	image, err := GetMovieImage_DB(c.Request.Context(), c.Param("movieId"), c.Param("imageId"))
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+
+	if err := SetPrimaryMovieImage_DB(c.Request.Context(), image.MovieId, image.ImageId); err != nil {
+		respondError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, response(http.StatusOK, true, "Primary image updated", nil))
+}
+
+// Handler for DELETE /api/movies/:movieId/images/:imageId
+func deleteMovieImage(c *gin.Context) {
+	slog.DebugContext(c.Request.Context(), "Inside deleteMovieImage func")
+
+	image, err := GetMovieImage_DB(c.Request.Context(), c.Param("movieId"), c.Param("imageId"))
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+
+	if err := DeleteMovieImage_DB(c.Request.Context(), image); err != nil {
+		respondError(c, err)
+		return
+	}
+
+	deleteCoverObjects(c.Request.Context(), coverObjectKeys(image.ImageKey, image.VariantKeys))
+
+	c.JSON(http.StatusOK, response(http.StatusOK, true, "Movie image deleted", nil))
+}
+
+const movieImageColumns = "imageId, movieId, kind, imageKey, variants, position, isPrimary, createdAt"
+
+func scanMovieImage(row rowScanner, image *MovieImage) error {
+	var variants string
+	if err := row.Scan(&image.ImageId, &image.MovieId, &image.Kind, &image.ImageKey, &variants, &image.Position, &image.IsPrimary, &image.CreatedAt); err != nil {
+		return err
+	}
+
+	if err := json.Unmarshal([]byte(variants), &image.VariantKeys); err != nil {
+		return err
+	}
+
+	image.ImageUrl = coverPublicURL(image.ImageKey)
+	image.Variants = map[string]CoverVariant{}
+	for name, variant := range image.VariantKeys {
+		variant.Jpeg, variant.Webp = coverPublicURL(variant.Jpeg), coverPublicURL(variant.Webp)
+		image.Variants[name] = variant
+	}
+
+	return nil
+}
+
+// Get the gallery of a movie in display order from DB
+func GetMovieImages_DB(ctx context.Context, movieId int) ([]MovieImage, error) {
+	slog.DebugContext(ctx, "Inside GetMovieImages_DB func")
+
+	ctx, cancel := dbContext(ctx)
+	defer cancel()
+
+	rows, err := db.QueryContext(ctx, "SELECT "+movieImageColumns+" FROM movie_images WHERE movieId = ? ORDER BY position, imageId", movieId)
+	if err != nil {
+		return nil, fmt.Errorf("GetMovieImages_DB error: %v", err)
+	}
+
+	defer rows.Close()
+
+	images := []MovieImage{}
+	for rows.Next() {
+		var image MovieImage
+
+		if err := scanMovieImage(rows, &image); err != nil {
+			return nil, fmt.Errorf("GetMovieImages_DB error: %v", err)
+		}
+
+		images = append(images, image)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("GetMovieImages_DB error: %v", err)
+	}
+
+	return images, nil
+}
+
+// Get a single gallery image of a movie from DB
+func GetMovieImage_DB(ctx context.Context, movieId string, imageId string) (MovieImage, error) {
+	slog.DebugContext(ctx, "Inside GetMovieImage_DB func")
+
+	ctx, cancel := dbContext(ctx)
+	defer cancel()
+
+	var image MovieImage
+	row := db.QueryRowContext(ctx, "SELECT "+movieImageColumns+" FROM movie_images WHERE movieId = ? AND imageId = ?", movieId, imageId)
+
+	if err := scanMovieImage(row, &image); err != nil {
+		if err == sql.ErrNoRows {
+			slog.DebugContext(ctx, "GetMovieImage_DB error", "error", err)
+			return image, newError(ErrNotFound, "No image found with given imageId for this movie")
+		}
+		return image, fmt.Errorf("GetMovieImage_DB error: %v", err)
+	}
+
+	return image, nil
+}
+
+// Add an image at the end of a movie's gallery in DB
+func AddMovieImage_DB(ctx context.Context, movieId int, kind string, upload coverUpload, primary bool) (MovieImage, error) {
+	slog.DebugContext(ctx, "Inside AddMovieImage_DB func")
+
+	ctx, cancel := dbContext(ctx)
+	defer cancel()
+
+	variants, err := json.Marshal(upload.Variants)
+	if err != nil {
+		return MovieImage{}, fmt.Errorf("AddMovieImage_DB error: %v", err)
+	}
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return MovieImage{}, fmt.Errorf("AddMovieImage_DB error: %v", err)
+	}
+	defer tx.Rollback()
+
+	// lock the gallery rows so concurrent uploads don't get the same position
+	var count, lastPosition int
+	if err := tx.QueryRowContext(ctx, "SELECT COUNT(*), COALESCE(MAX(position), -1) FROM movie_images WHERE movieId = ? FOR UPDATE", movieId).Scan(&count, &lastPosition); err != nil {
+		return MovieImage{}, fmt.Errorf("AddMovieImage_DB error: %v", err)
+	}
+
+	primary = primary || count == 0
+	if primary {
+		if _, err := tx.ExecContext(ctx, "UPDATE movie_images SET isPrimary = FALSE WHERE movieId = ?", movieId); err != nil {
+			return MovieImage{}, fmt.Errorf("AddMovieImage_DB error: %v", err)
+		}
+	}
+
+	result, err := tx.ExecContext(ctx, "INSERT INTO movie_images (movieId, kind, imageKey, variants, position, isPrimary) VALUES (?,?,?,?,?,?)",
+		movieId, kind, upload.Key, string(variants), lastPosition+1, primary)
+	if err != nil {
+		return MovieImage{}, fmt.Errorf("AddMovieImage_DB error: %v", err)
+	}
+
+	imageId, err := result.LastInsertId()
+	if err != nil {
+		return MovieImage{}, fmt.Errorf("AddMovieImage_DB error: %v", err)
+	}
+
+	var image MovieImage
+	row := tx.QueryRowContext(ctx, "SELECT "+movieImageColumns+" FROM movie_images WHERE imageId = ?", imageId)
+	if err := scanMovieImage(row, &image); err != nil {
+		return MovieImage{}, fmt.Errorf("AddMovieImage_DB error: %v", err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return MovieImage{}, fmt.Errorf("AddMovieImage_DB error: %v", err)
+	}
+
+	return image, nil
+}
+
+// Set the position of every image of a movie from the given order in DB
+func ReorderMovieImages_DB(ctx context.Context, movieId int, imageIds []int) error {
+	slog.DebugContext(ctx, "Inside ReorderMovieImages_DB func")
+
+	ctx, cancel := dbContext(ctx)
+	defer cancel()
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("ReorderMovieImages_DB error: %v", err)
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.QueryContext(ctx, "SELECT imageId FROM movie_images WHERE movieId = ? FOR UPDATE", movieId)
+	if err != nil {
+		return fmt.Errorf("ReorderMovieImages_DB error: %v", err)
+	}
+
+	existing := map[int]bool{}
+	for rows.Next() {
+		var imageId int
+		if err := rows.Scan(&imageId); err != nil {
+			rows.Close()
+			return fmt.Errorf("ReorderMovieImages_DB error: %v", err)
+		}
+		existing[imageId] = true
+	}
+	rows.Close()
+
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("ReorderMovieImages_DB error: %v", err)
+	}
+
+	// the new order must be a permutation of the current images
+	seen := map[int]bool{}
+	for _, imageId := range imageIds {
+		if !existing[imageId] || seen[imageId] {
+			return invalidField("imageIds", "must list each image of the movie exactly once")
+		}
+		seen[imageId] = true
+	}
+	if len(seen) != len(existing) {
+		return invalidField("imageIds", "must list each image of the movie exactly once")
+	}
+
+	for position, imageId := range imageIds {
+		if _, err := tx.ExecContext(ctx, "UPDATE movie_images SET position = ? WHERE imageId = ?", position, imageId); err != nil {
+			return fmt.Errorf("ReorderMovieImages_DB error: %v", err)
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("ReorderMovieImages_DB error: %v", err)
+	}
+
+	return nil
+}
+
+// Make an image the primary image of its movie in DB
+func SetPrimaryMovieImage_DB(ctx context.Context, movieId int, imageId int) error {
+	slog.DebugContext(ctx, "Inside SetPrimaryMovieImage_DB func")
+
+	ctx, cancel := dbContext(ctx)
+	defer cancel()
+
+	_, err := db.ExecContext(ctx, "UPDATE movie_images SET isPrimary = (imageId = ?) WHERE movieId = ?", imageId, movieId)
+	if err != nil {
+		return fmt.Errorf("SetPrimaryMovieImage_DB error: %v", err)
+	}
+
+	return nil
+}
+
+// Delete a gallery image in DB, when it was the primary image the first remaining one takes over
+func DeleteMovieImage_DB(ctx context.Context, image MovieImage) error {
+	slog.DebugContext(ctx, "Inside DeleteMovieImage_DB func")
+
+	ctx, cancel := dbContext(ctx)
+	defer cancel()
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("DeleteMovieImage_DB error: %v", err)
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx, "DELETE FROM movie_images WHERE imageId = ?", image.ImageId); err != nil {
+		return fmt.Errorf("DeleteMovieImage_DB error: %v", err)
+	}
+
+	if image.IsPrimary {
+		if _, err := tx.ExecContext(ctx, "UPDATE movie_images SET isPrimary = TRUE WHERE movieId = ? ORDER BY position, imageId LIMIT 1", image.MovieId); err != nil {
+			return fmt.Errorf("DeleteMovieImage_DB error: %v", err)
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("DeleteMovieImage_DB error: %v", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"strings"
+
+	"github.com/AJ-Walker/movies-rest-api/config"
+)
+
+// ChatMessage is a single conversation turn sent to the model
+type ChatMessage struct {
+	Role    string       `json:"role"`
+	Content string       `json:"content"`
+	Images  []ImageInput `json:"-"`
+}
+
+// ImageInput is an image sent to the model along with the text of a message
+type ImageInput struct {
+	Format string // jpeg, png, gif or webp
+	Bytes  []byte
+}
+
+const (
+	ROLE_USER      string = "user"
+	ROLE_ASSISTANT string = "assistant"
+)
+
+// GenerationRequest holds everything a model call needs, independent of the provider
+type GenerationRequest struct {
+	System    string
+	Messages  []ChatMessage
+	MaxTokens int32
+	// Operation and UserId are used for usage accounting
+	Operation string
+	UserId    string
+}
+
+// GenerationResult is the text produced by the model along with its token usage
+type GenerationResult struct {
+	Text         string
+	ModelId      string
+	InputTokens  int
+	OutputTokens int
+}
+
+// SummaryGenerator is the abstraction every LLM feature goes through, so handlers
+// never talk to Bedrock directly and can be run against the fake generator offline.
+type SummaryGenerator interface {
+	Generate(ctx context.Context, req GenerationRequest) (GenerationResult, error)
+	// GenerateStream calls onDelta for every chunk of text as it arrives
+	GenerateStream(ctx context.Context, req GenerationRequest, onDelta func(string) error) (GenerationResult, error)
+}
+
+var Generator SummaryGenerator
+
+// Pick the generator implementation based on the llm.generator setting (bedrock by default)
+func InitGenerator() {
+	switch appConfig.LLM.Generator {
+	case config.GENERATOR_FAKE:
+		slog.Info("Using fake summary generator")
+		Generator = usageTrackingGenerator{next: fakeGenerator{}}
+	default:
+		Generator = usageTrackingGenerator{next: newBedrockGenerator()}
+	}
+}
+
+// fakeGenerator returns deterministic responses without calling any model
+type fakeGenerator struct{}
+
+func (fakeGenerator) Generate(ctx context.Context, req GenerationRequest) (GenerationResult, error) {
+	if len(req.Messages) == 0 {
+		return GenerationResult{}, fmt.Errorf("no messages to generate from")
+	}
+
+	last := req.Messages[len(req.Messages)-1].Content
+	text := fmt.Sprintf("This is a generated response to: %v", last)
+
+	inputTokens := estimateTokens(req.System)
+	for _, message := range req.Messages {
+		inputTokens += estimateTokens(message.Content)
+	}
+
+	return GenerationResult{
+		Text:         text,
+		ModelId:      "fake",
+		InputTokens:  inputTokens,
+		OutputTokens: estimateTokens(text),
+	}, nil
+}
+
+func (g fakeGenerator) GenerateStream(ctx context.Context, req GenerationRequest, onDelta func(string) error) (GenerationResult, error) {
+	result, err := g.Generate(ctx, req)
+	if err != nil {
+		return result, err
+	}
+
+	for _, word := range strings.SplitAfter(result.Text, " ") {
+		if err := onDelta(word); err != nil {
+			return result, err
+		}
+	}
+
+	return result, nil
+}
+
+// Rough token estimate (~4 characters per token), good enough for budgeting the context window
+func estimateTokens(text string) int {
+	if text == "" {
+		return 0
+	}
+	return len(text)/4 + 1
+}
+
+// Estimated USD cost of a call based on the per 1K token pricing of the model
+func estimateCost(modelId string, inputTokens int, outputTokens int) float64 {
+	pricing, ok := MODEL_PRICING[modelId]
+	if !ok {
+		return 0
+	}
+
+	return float64(inputTokens)/1000*pricing.InputPer1K + float64(outputTokens)/1000*pricing.OutputPer1K
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net/http"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/AJ-Walker/movies-rest-api/config"
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	HEALTH_OK          string = "ok"
+	HEALTH_DEGRADED    string = "degraded"    // an optional dependency is failing, still serving
+	HEALTH_UNAVAILABLE string = "unavailable" // a required dependency is failing, take out of rotation
+)
+
+// Probe routes, called every few seconds, so they are neither traced nor access logged
+var probeRoutes = []string{"/healthcheck", "/livez", "/readyz", "/metrics"}
+
+// healthChecker is implemented by dependencies that can tell whether they are usable,
+// e.g. the generator when every model has an open circuit
+type healthChecker interface {
+	Check(ctx context.Context) error
+}
+
+// CheckResult is the outcome of a single readiness check
+type CheckResult struct {
+	Status    string  `json:"status"`
+	Optional  bool    `json:"optional"`
+	LatencyMs float64 `json:"latencyMs"`
+	Error     string  `json:"error,omitempty"`
+}
+
+// ReadinessReport is the body of /readyz, with a result per dependency
+type ReadinessReport struct {
+	Status    string                 `json:"status"`
+	Checks    map[string]CheckResult `json:"checks"`
+	CheckedAt time.Time              `json:"checkedAt"`
+}
+
+type readinessCheck struct {
+	name     string
+	optional bool
+	check    func(ctx context.Context) error
+}
+
+// readiness runs the registered checks in parallel and caches the report for
+// health.cacheTtl, so frequent probes don't hammer the dependencies
+type readiness struct {
+	mu           sync.Mutex
+	checks       []readinessCheck
+	report       ReadinessReport
+	shuttingDown atomic.Bool
+}
+
+var Readiness = &readiness{}
+
+// Register the checks of every dependency, after the DB, blob store and generator are set up
+func registerHealthChecks() {
+	Readiness.Register(config.CHECK_DATABASE, func(ctx context.Context) error {
+		return db.PingContext(ctx)
+	})
+	Readiness.Register(config.CHECK_STORAGE, func(ctx context.Context) error {
+		return Blobs.Ping(ctx)
+	})
+	Readiness.Register(config.CHECK_GENERATOR, func(ctx context.Context) error {
+		if checker, ok := Generator.(healthChecker); ok {
+			return checker.Check(ctx)
+		}
+		return nil
+	})
+}
+
+// Register a check, whether it is optional comes from the health.optional setting (HEALTH_OPTIONAL)
+func (r *readiness) Register(name string, check func(ctx context.Context) error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	optional := slices.Contains(appConfig.Health.OptionalChecks(), name)
+	r.checks = append(r.checks, readinessCheck{name: name, optional: optional, check: check})
+}
+
+// Run every check, or return the cached report while it is fresh
+func (r *readiness) Check(ctx context.Context) ReadinessReport {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if !r.report.CheckedAt.IsZero() && time.Since(r.report.CheckedAt) < appConfig.Health.CacheTTL {
+		return r.report
+	}
+
+	// the result is shared with other probes, so it shouldn't fail because this one went away
+	ctx = context.WithoutCancel(ctx)
+
+	results := make([]CheckResult, len(r.checks))
+	errs := make([]error, len(r.checks))
+	var wg sync.WaitGroup
+	for i, check := range r.checks {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			results[i], errs[i] = runCheck(ctx, check)
+		}()
+	}
+	wg.Wait()
+
+	report := ReadinessReport{Status: HEALTH_OK, Checks: map[string]CheckResult{}, CheckedAt: time.Now()}
+	for i, check := range r.checks {
+		result := results[i]
+		report.Checks[check.name] = result
+
+		if result.Status == HEALTH_OK {
+			continue
+		}
+		slog.WarnContext(ctx, "Readiness check failed", "check", check.name, "optional", check.optional, "error", errs[i])
+
+		if !check.optional {
+			report.Status = HEALTH_UNAVAILABLE
+		} else if report.Status == HEALTH_OK {
+			report.Status = HEALTH_DEGRADED
+		}
+	}
+
+	r.report = report
+	return report
+}
+
+// Run a check. The result only says that it failed, the body of /readyz is public and
+// driver or AWS error strings stay in the returned error for the log.
+func runCheck(ctx context.Context, check readinessCheck) (CheckResult, error) {
+	ctx, cancel := context.WithTimeout(ctx, appConfig.Health.Timeout)
+	defer cancel()
+
+	start := time.Now()
+	err := check.check(ctx)
+	result := CheckResult{
+		Status:    HEALTH_OK,
+		Optional:  check.optional,
+		LatencyMs: float64(time.Since(start).Microseconds()) / 1000,
+	}
+
+	if err != nil {
+		result.Status = HEALTH_DEGRADED
+		if !check.optional {
+			result.Status = HEALTH_UNAVAILABLE
+		}
+		result.Error = "check failed"
+		if errors.Is(err, context.DeadlineExceeded) {
+			result.Error = "timed out after " + appConfig.Health.Timeout.String()
+		}
+	}
+
+	return result, err
+}
+
+// Handler for /livez, the process is up and serving. Doesn't look at any dependency, a
+// restart wouldn't fix those.
+func livez(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{"status": HEALTH_OK})
+}
+
+// Handler for /readyz, 200 while ok or degraded and 503 when a required dependency is
+// failing or the server is shutting down
+func readyz(c *gin.Context) {
+	if Readiness.shuttingDown.Load() {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"status": HEALTH_UNAVAILABLE, "error": "shutting down"})
+		return
+	}
+
+	report := Readiness.Check(c.Request.Context())
+
+	statusCode := http.StatusOK
+	if report.Status == HEALTH_UNAVAILABLE {
+		statusCode = http.StatusServiceUnavailable
+	}
+
+	c.JSON(statusCode, report)
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/AJ-Walker/movies-rest-api/config"
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	IMAGE_PROXY_ROUTE string = "/api/images"
+
+	// signed urls stay the same for a whole window so clients and CDNs can cache them
+	IMAGE_URL_WINDOW      time.Duration = 24 * time.Hour
+	IMAGE_REDIRECT_EXPIRY time.Duration = 15 * time.Minute
+)
+
+// How cover urls are handed to clients (COVER_DELIVERY), see coverPublicURL
+func coverDelivery() string {
+	return appConfig.Storage.CoverDelivery
+}
+
+// Secret for signing proxy urls, required unless COVER_DELIVERY=public. Proxy urls are
+// only unsigned then, for images that are public anyway.
+func imageUrlSecret() []byte {
+	return []byte(appConfig.Storage.ImageURLSecret)
+}
+
+func signImageKey(key string, expires int64) string {
+	mac := hmac.New(sha256.New, imageUrlSecret())
+	fmt.Fprintf(mac, "%v\n%d", key, expires)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// Url of an object through the image proxy, on COVER_BASE_URL when a CDN fronts the
+// proxy, otherwise on PUBLIC_BASE_URL
+func imageProxyURL(key string) string {
+	baseUrl := appConfig.Storage.CoverBaseURL
+	if baseUrl == "" {
+		baseUrl = strings.TrimSuffix(appConfig.Server.PublicBaseURL, "/") + IMAGE_PROXY_ROUTE
+	}
+
+	imageUrl := fmt.Sprintf("%v/%v", strings.TrimSuffix(baseUrl, "/"), key)
+	if len(imageUrlSecret()) == 0 {
+		return imageUrl
+	}
+
+	// expire at the end of the next full window, so a url is valid for at least one window
+	expires := time.Now().Truncate(IMAGE_URL_WINDOW).Add(2 * IMAGE_URL_WINDOW).Unix()
+
+	query := url.Values{}
+	query.Set("expires", strconv.FormatInt(expires, 10))
+	query.Set("signature", signImageKey(key, expires))
+
+	return fmt.Sprintf("%v?%v", imageUrl, query.Encode())
+}
+
+// Check the signature of a proxy url, returns when it expires
+func verifyImageSignature(c *gin.Context, key string) (time.Time, error) {
+	expires, err := strconv.ParseInt(c.Query("expires"), 10, 64)
+	if err != nil {
+		return time.Time{}, newError(ErrForbidden, "image url is not signed")
+	}
+
+	if !hmac.Equal([]byte(signImageKey(key, expires)), []byte(c.Query("signature"))) {
+		return time.Time{}, newError(ErrForbidden, "invalid image url signature")
+	}
+
+	expiresAt := time.Unix(expires, 0)
+	if time.Now().After(expiresAt) {
+		return time.Time{}, newError(ErrForbidden, "image url has expired")
+	}
+
+	return expiresAt, nil
+}
+
+// Handler for GET /api/images/*key
+// Streams a stored image with caching headers, ETag and Range support, or redirects to a
+// presigned url with COVER_DELIVERY=redirect
+func getImage(c *gin.Context) {
+	slog.DebugContext(c.Request.Context(), "Inside getImage func")
+
+	key := strings.TrimPrefix(c.Param("key"), "/")
+
+	// only published images, never staged uploads
+	if !strings.HasPrefix(key, s3Prefix+"/") {
+		respondError(c, ErrObjectNotFound)
+		return
+	}
+
+	// keys are never reused, an image can be cached for as long as its url is valid
+	cacheControl := "public, max-age=31536000, immutable"
+	if len(imageUrlSecret()) > 0 {
+		expiresAt, err := verifyImageSignature(c, key)
+		if err != nil {
+			respondError(c, err)
+			return
+		}
+		cacheControl = fmt.Sprintf("public, max-age=%d, immutable", int(time.Until(expiresAt).Seconds()))
+	}
+
+	if coverDelivery() == config.COVER_DELIVERY_REDIRECT {
+		presignedUrl, err := Blobs.PresignGet(c.Request.Context(), key, IMAGE_REDIRECT_EXPIRY)
+		if err != nil {
+			respondError(c, err)
+			return
+		}
+
+		// the redirect itself can only be cached while the presigned url works
+		c.Header("Cache-Control", fmt.Sprintf("private, max-age=%d", int(IMAGE_REDIRECT_EXPIRY.Seconds())-60))
+		c.Redirect(http.StatusFound, presignedUrl)
+		return
+	}
+
+	body, info, err := Blobs.Open(c.Request.Context(), key)
+	if errors.Is(err, ErrObjectNotFound) {
+		respondError(c, ErrObjectNotFound)
+		return
+	}
+	if err != nil {
+		respondError(c, wrapError(ErrUpstream, "error reading image", err))
+		return
+	}
+
+	defer body.Close()
+
+	etag := info.ETag
+	if etag != "" && !strings.HasPrefix(etag, `"`) {
+		etag = strconv.Quote(etag)
+	}
+
+	c.Header("Cache-Control", cacheControl)
+	c.Header("ETag", etag)
+	c.Header("X-Content-Type-Options", "nosniff")
+	if info.ContentType != "" {
+		c.Header("Content-Type", info.ContentType)
+	}
+
+	// handles Range, If-None-Match, If-Modified-Since and HEAD
+	http.ServeContent(c.Writer, c.Request, "", info.LastModified, body)
+}
@@ -0,0 +1,390 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"image"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"log/slog"
+	"mime/multipart"
+	"net/http"
+
+	"github.com/gen2brain/webp"
+	"golang.org/x/image/draw"
+)
+
+const (
+	MAX_COVER_BYTES      int64 = 10 << 20 // 10 MiB
+	MIN_COVER_DIMENSION  int   = 100
+	MAX_COVER_DIMENSION  int   = 8000
+	MAX_COVER_PIXELS     int   = 40_000_000
+	COVER_JPEG_QUALITY   int   = 85
+	COVER_WEBP_QUALITY   int   = 80
+	COVER_ORIGINAL_WIDTH int   = 2048
+)
+
+// Allowed cover formats, detected from the file content and not from the name or Content-Type
+var coverFormats = map[string]string{
+	"image/jpeg": "jpeg",
+	"image/png":  "png",
+	"image/webp": "webp",
+}
+
+// Widths of the generated variants, each one is stored as JPEG and WebP
+var coverVariantWidths = map[string]int{
+	"thumbnail": 160,
+	"medium":    480,
+	"large":     1024,
+}
+
+// CoverVariant is a resized copy of the cover. Jpeg and Webp hold object keys in DB
+// and public urls in API responses.
+type CoverVariant struct {
+	Width  int    `json:"width"`
+	Height int    `json:"height"`
+	Jpeg   string `json:"jpeg"`
+	Webp   string `json:"webp"`
+}
+
+// An uploaded cover: the key of the re-encoded original, the variant keys, and the
+// original bytes for alt text generation
+type coverUpload struct {
+	Key      string
+	Variants map[string]CoverVariant
+	Image    []byte
+	Format   string
+}
+
+type encodedImage struct {
+	data        []byte
+	contentType string
+}
+
+// Validate and decode a cover image. The image is fully decoded only after the
+// format and dimensions are checked, so oversized images are rejected cheaply.
+func decodeCoverImage(data []byte) (image.Image, string, error) {
+	slog.Debug("Inside decodeCoverImage func")
+
+	format, ok := coverFormats[http.DetectContentType(data)]
+	if !ok {
+		return nil, "", newError(ErrValidation, "unsupported cover image format, allowed formats are JPEG, PNG and WebP")
+	}
+
+	config, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil, "", wrapError(ErrValidation, "invalid cover image", err)
+	}
+
+	if config.Width < MIN_COVER_DIMENSION || config.Height < MIN_COVER_DIMENSION {
+		return nil, "", newError(ErrValidation, fmt.Sprintf("cover image must be at least %dx%d pixels", MIN_COVER_DIMENSION, MIN_COVER_DIMENSION))
+	}
+	if config.Width > MAX_COVER_DIMENSION || config.Height > MAX_COVER_DIMENSION || config.Width*config.Height > MAX_COVER_PIXELS {
+		return nil, "", newError(ErrValidation, fmt.Sprintf("cover image cannot be larger than %dx%d pixels", MAX_COVER_DIMENSION, MAX_COVER_DIMENSION))
+	}
+
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, "", wrapError(ErrValidation, "invalid cover image", err)
+	}
+
+	// decoding drops EXIF and other metadata, keep only the orientation it describes
+	if format == "jpeg" {
+		img = applyOrientation(img, jpegOrientation(data))
+	}
+
+	return img, format, nil
+}
+
+// Scale an image down to the given width keeping the aspect ratio, never up
+func resizeToWidth(img image.Image, width int) image.Image {
+	bounds := img.Bounds()
+	if bounds.Dx() <= width {
+		return img
+	}
+
+	height := max(1, bounds.Dy()*width/bounds.Dx())
+	resized := image.NewRGBA(image.Rect(0, 0, width, height))
+	draw.CatmullRom.Scale(resized, resized.Bounds(), img, bounds, draw.Src, nil)
+
+	return resized
+}
+
+// Draw an image with transparency onto a white background, JPEG has no alpha channel
+// and would turn transparent pixels black
+func flattenImage(img image.Image) image.Image {
+	if opaque, ok := img.(interface{ Opaque() bool }); ok && opaque.Opaque() {
+		return img
+	}
+
+	bounds := img.Bounds()
+	flat := image.NewRGBA(image.Rect(0, 0, bounds.Dx(), bounds.Dy()))
+	draw.Draw(flat, flat.Bounds(), image.White, image.Point{}, draw.Src)
+	draw.Draw(flat, flat.Bounds(), img, bounds.Min, draw.Over)
+
+	return flat
+}
+
+func encodeJPEG(img image.Image) (encodedImage, error) {
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, flattenImage(img), &jpeg.Options{Quality: COVER_JPEG_QUALITY}); err != nil {
+		return encodedImage{}, err
+	}
+
+	return encodedImage{data: buf.Bytes(), contentType: "image/jpeg"}, nil
+}
+
+func encodePNG(img image.Image) (encodedImage, error) {
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		return encodedImage{}, err
+	}
+
+	return encodedImage{data: buf.Bytes(), contentType: "image/png"}, nil
+}
+
+func encodeWebP(img image.Image) (encodedImage, error) {
+	var buf bytes.Buffer
+	if err := webp.Encode(&buf, img, webp.Options{Quality: COVER_WEBP_QUALITY, Method: webp.DefaultMethod}); err != nil {
+		return encodedImage{}, err
+	}
+
+	return encodedImage{data: buf.Bytes(), contentType: "image/webp"}, nil
+}
+
+// Validate a cover uploaded through a multipart form and store it with its variants
+func uploadCoverImage(ctx context.Context, fileHeader *multipart.FileHeader, name string) (coverUpload, error) {
+	slog.DebugContext(ctx, "Inside uploadCoverImage func")
+
+	if fileHeader.Size > MAX_COVER_BYTES {
+		return coverUpload{}, newError(ErrValidation, fmt.Sprintf("cover image cannot be larger than %d MiB", MAX_COVER_BYTES>>20))
+	}
+
+	file, err := fileHeader.Open()
+	if err != nil {
+		slog.ErrorContext(ctx, "Error opening file to upload", "filename", fileHeader.Filename, "error", err)
+		return coverUpload{}, err
+	}
+
+	defer file.Close()
+
+	data, err := io.ReadAll(io.LimitReader(file, MAX_COVER_BYTES+1))
+	if err != nil {
+		return coverUpload{}, err
+	}
+	if int64(len(data)) > MAX_COVER_BYTES {
+		return coverUpload{}, newError(ErrValidation, fmt.Sprintf("cover image cannot be larger than %d MiB", MAX_COVER_BYTES>>20))
+	}
+
+	return storeCoverImage(ctx, data, name)
+}
+
+// Validate a cover, re-encode it without metadata and store it with its variants
+// as images/<name>.<ext> and images/<name>_<variant>.<jpg|webp>
+func storeCoverImage(ctx context.Context, data []byte, name string) (coverUpload, error) {
+	slog.DebugContext(ctx, "Inside storeCoverImage func")
+
+	img, format, err := decodeCoverImage(data)
+	if err != nil {
+		return coverUpload{}, err
+	}
+
+	// PNG keeps transparency, everything else is stored as JPEG
+	original := resizeToWidth(img, COVER_ORIGINAL_WIDTH)
+	encode, extension := encodeJPEG, "jpg"
+	if format == "png" {
+		encode, extension = encodePNG, "png"
+	}
+
+	encoded, err := encode(original)
+	if err != nil {
+		return coverUpload{}, fmt.Errorf("storeCoverImage error: %v", err)
+	}
+
+	upload := coverUpload{
+		Key:      fmt.Sprintf("%v/%v.%v", s3Prefix, name, extension),
+		Variants: map[string]CoverVariant{},
+		Image:    encoded.data,
+		Format:   extension,
+	}
+	if extension == "jpg" {
+		upload.Format = "jpeg"
+	}
+
+	objects := map[string]encodedImage{upload.Key: encoded}
+
+	for variantName, width := range coverVariantWidths {
+		resized := resizeToWidth(img, width)
+
+		jpegImage, err := encodeJPEG(resized)
+		if err != nil {
+			return coverUpload{}, fmt.Errorf("storeCoverImage error: %v", err)
+		}
+
+		webpImage, err := encodeWebP(resized)
+		if err != nil {
+			return coverUpload{}, fmt.Errorf("storeCoverImage error: %v", err)
+		}
+
+		variant := CoverVariant{
+			Width:  resized.Bounds().Dx(),
+			Height: resized.Bounds().Dy(),
+			Jpeg:   fmt.Sprintf("%v/%v_%v.jpg", s3Prefix, name, variantName),
+			Webp:   fmt.Sprintf("%v/%v_%v.webp", s3Prefix, name, variantName),
+		}
+
+		objects[variant.Jpeg] = jpegImage
+		objects[variant.Webp] = webpImage
+		upload.Variants[variantName] = variant
+	}
+
+	var uploaded []string
+	for key, object := range objects {
+		if err := putObject(ctx, key, object.data, object.contentType); err != nil {
+			// don't leave a partial set of objects behind
+			deleteCoverObjects(ctx, uploaded)
+			return coverUpload{}, err
+		}
+		uploaded = append(uploaded, key)
+	}
+
+	return upload, nil
+}
+
+// Object keys of a cover and all of its variants
+func coverObjectKeys(coverKey string, variants map[string]CoverVariant) []string {
+	keys := []string{coverKey}
+	for _, variant := range variants {
+		keys = append(keys, variant.Jpeg, variant.Webp)
+	}
+
+	return keys
+}
+
+// Orientation from the EXIF data of a JPEG, 1 (normal) when missing or unreadable
+func jpegOrientation(data []byte) int {
+	reader := bytes.NewReader(data)
+
+	var marker [2]byte
+	if _, err := io.ReadFull(reader, marker[:]); err != nil || marker != [2]byte{0xFF, 0xD8} {
+		return 1
+	}
+
+	for {
+		if _, err := io.ReadFull(reader, marker[:]); err != nil || marker[0] != 0xFF {
+			return 1
+		}
+
+		var length uint16
+		if err := binary.Read(reader, binary.BigEndian, &length); err != nil || length < 2 {
+			return 1
+		}
+
+		segment := make([]byte, length-2)
+		if _, err := io.ReadFull(reader, segment); err != nil {
+			return 1
+		}
+
+		// APP1 with an Exif header, stop at start of scan
+		if marker[1] == 0xE1 && bytes.HasPrefix(segment, []byte("Exif\x00\x00")) {
+			return exifOrientation(segment[6:])
+		}
+		if marker[1] == 0xDA {
+			return 1
+		}
+	}
+}
+
+// Read the orientation tag (0x0112) from the first IFD of a TIFF structure
+func exifOrientation(tiff []byte) int {
+	if len(tiff) < 8 {
+		return 1
+	}
+
+	var order binary.ByteOrder
+	switch string(tiff[:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return 1
+	}
+
+	offset := int(order.Uint32(tiff[4:8]))
+	if offset+2 > len(tiff) {
+		return 1
+	}
+
+	entries := int(order.Uint16(tiff[offset:]))
+	for i := 0; i < entries; i++ {
+		entry := offset + 2 + i*12
+		if entry+12 > len(tiff) {
+			return 1
+		}
+
+		if order.Uint16(tiff[entry:]) == 0x0112 {
+			orientation := int(order.Uint16(tiff[entry+8:]))
+			if orientation < 1 || orientation > 8 {
+				return 1
+			}
+			return orientation
+		}
+	}
+
+	return 1
+}
+
+// Rotate and flip an image so it displays upright for the given EXIF orientation. Works
+// on the pixel bytes, At and Set per pixel are too slow for camera sized photos.
+func applyOrientation(img image.Image, orientation int) image.Image {
+	if orientation <= 1 || orientation > 8 {
+		return img
+	}
+
+	src, ok := img.(*image.RGBA)
+	if !ok {
+		// decoded JPEGs are YCbCr, draw converts them in one pass
+		src = image.NewRGBA(img.Bounds())
+		draw.Draw(src, src.Bounds(), img, img.Bounds().Min, draw.Src)
+	}
+
+	bounds := src.Bounds()
+	width, height := bounds.Dx(), bounds.Dy()
+
+	// orientations 5-8 swap width and height
+	outWidth, outHeight := width, height
+	if orientation >= 5 {
+		outWidth, outHeight = height, width
+	}
+
+	oriented := image.NewRGBA(image.Rect(0, 0, outWidth, outHeight))
+	for y := 0; y < height; y++ {
+		row := src.Pix[src.PixOffset(bounds.Min.X, bounds.Min.Y+y):]
+		for x := 0; x < width; x++ {
+			var dx, dy int
+			switch orientation {
+			case 2:
+				dx, dy = width-1-x, y
+			case 3:
+				dx, dy = width-1-x, height-1-y
+			case 4:
+				dx, dy = x, height-1-y
+			case 5:
+				dx, dy = y, x
+			case 6:
+				dx, dy = height-1-y, x
+			case 7:
+				dx, dy = height-1-y, width-1-x
+			case 8:
+				dx, dy = y, width-1-x
+			}
+			copy(oriented.Pix[dy*oriented.Stride+dx*4:dy*oriented.Stride+dx*4+4], row[x*4:x*4+4])
+		}
+	}
+
+	return oriented
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"testing"
+
+	"golang.org/x/image/draw"
+)
+
+func TestApplyOrientation(t *testing.T) {
+	// 3x2 with a red top left and a green top right corner. NRGBA, not RGBA, so the
+	// conversion is covered too.
+	src := image.NewNRGBA(image.Rect(0, 0, 3, 2))
+	red, green := color.NRGBA{255, 0, 0, 255}, color.NRGBA{0, 255, 0, 255}
+	src.Set(0, 0, red)
+	src.Set(2, 0, green)
+
+	tests := []struct {
+		orientation   int
+		width, height int
+		red, green    image.Point
+	}{
+		{1, 3, 2, image.Pt(0, 0), image.Pt(2, 0)},
+		{2, 3, 2, image.Pt(2, 0), image.Pt(0, 0)},
+		{3, 3, 2, image.Pt(2, 1), image.Pt(0, 1)},
+		{4, 3, 2, image.Pt(0, 1), image.Pt(2, 1)},
+		{5, 2, 3, image.Pt(0, 0), image.Pt(0, 2)},
+		{6, 2, 3, image.Pt(1, 0), image.Pt(1, 2)},
+		{7, 2, 3, image.Pt(1, 2), image.Pt(1, 0)},
+		{8, 2, 3, image.Pt(0, 2), image.Pt(0, 0)},
+	}
+
+	for _, test := range tests {
+		oriented := applyOrientation(src, test.orientation)
+
+		if bounds := oriented.Bounds(); bounds.Dx() != test.width || bounds.Dy() != test.height {
+			t.Errorf("orientation %d: expected %dx%d, got %dx%d", test.orientation, test.width, test.height, bounds.Dx(), bounds.Dy())
+			continue
+		}
+
+		for _, corner := range []struct {
+			at   image.Point
+			want color.NRGBA
+		}{{test.red, red}, {test.green, green}} {
+			if got := color.NRGBAModel.Convert(oriented.At(corner.at.X, corner.at.Y)); got != corner.want {
+				t.Errorf("orientation %d: expected %v at %v, got %v", test.orientation, corner.want, corner.at, got)
+			}
+		}
+	}
+}
+
+func TestEncodeJPEGFlattensTransparency(t *testing.T) {
+	tests := []struct {
+		name  string
+		pixel color.NRGBA
+		want  color.RGBA
+	}{
+		{"transparent becomes white", color.NRGBA{0, 0, 0, 0}, color.RGBA{255, 255, 255, 255}},
+		{"half transparent red is blended", color.NRGBA{255, 0, 0, 128}, color.RGBA{255, 127, 127, 255}},
+		{"opaque blue is kept", color.NRGBA{0, 0, 255, 255}, color.RGBA{0, 0, 255, 255}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			src := image.NewNRGBA(image.Rect(0, 0, 16, 16))
+			draw.Draw(src, src.Bounds(), image.NewUniform(test.pixel), image.Point{}, draw.Src)
+
+			// through the resize like the variants, which keeps the alpha channel
+			encoded, err := encodeJPEG(resizeToWidth(src, 8))
+			if err != nil {
+				t.Fatalf("unexpected error %v", err)
+			}
+
+			decoded, err := jpeg.Decode(bytes.NewReader(encoded.data))
+			if err != nil {
+				t.Fatalf("cannot decode the JPEG: %v", err)
+			}
+
+			// JPEG is lossy, allow a small difference per channel
+			got := color.RGBAModel.Convert(decoded.At(4, 4)).(color.RGBA)
+			for i, pair := range [][2]uint8{{got.R, test.want.R}, {got.G, test.want.G}, {got.B, test.want.B}} {
+				if diff := int(pair[0]) - int(pair[1]); diff < -8 || diff > 8 {
+					t.Errorf("channel %d: expected %v, got %v", i, test.want, got)
+				}
+			}
+		})
+	}
+}
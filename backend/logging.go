@@ -0,0 +1,158 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"regexp"
+	"runtime/debug"
+	"slices"
+	"time"
+
+	"github.com/AJ-Walker/movies-rest-api/config"
+	"github.com/gin-gonic/gin"
+	"github.com/go-sql-driver/mysql"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const REQUEST_ID_HEADER string = "X-Request-ID"
+
+// an incoming request id is reused only when it looks like an id, so clients can't inject
+// arbitrary text into the logs
+var requestIdPattern = regexp.MustCompile(`^[A-Za-z0-9._:-]{1,128}$`)
+
+type requestIdKey struct{}
+
+// Request id the context belongs to, empty outside of a request
+func requestIdFrom(ctx context.Context) string {
+	requestId, _ := ctx.Value(requestIdKey{}).(string)
+	return requestId
+}
+
+func withRequestId(ctx context.Context, requestId string) context.Context {
+	return context.WithValue(ctx, requestIdKey{}, requestId)
+}
+
+// Replace the default logger with a JSON (or text) slog logger at the configured level.
+// The standard log package and the MySQL driver log through it as well.
+func InitLogger() {
+	level, err := appConfig.Log.SlogLevel()
+	if err != nil {
+		level = slog.LevelInfo
+	}
+
+	options := &slog.HandlerOptions{Level: level}
+	var handler slog.Handler = slog.NewJSONHandler(os.Stderr, options)
+	if appConfig.Log.Format == config.LOG_TEXT {
+		handler = slog.NewTextHandler(os.Stderr, options)
+	}
+
+	slog.SetDefault(slog.New(contextHandler{handler}))
+	mysql.SetLogger(slog.NewLogLogger(slog.Default().Handler(), slog.LevelWarn))
+
+	// gin prints every route on startup in debug mode
+	if level > slog.LevelDebug && os.Getenv(gin.EnvGinMode) == "" {
+		gin.SetMode(gin.ReleaseMode)
+	}
+}
+
+// Log an error and exit, for failures during startup
+func logFatal(msg string, args ...any) {
+	slog.Error(msg, args...)
+	os.Exit(1)
+}
+
+// contextHandler adds the request id and the trace of the context to every record
+type contextHandler struct {
+	slog.Handler
+}
+
+func (h contextHandler) Handle(ctx context.Context, record slog.Record) error {
+	if requestId := requestIdFrom(ctx); requestId != "" {
+		record.AddAttrs(slog.String("requestId", requestId))
+	}
+	if spanContext := trace.SpanContextFromContext(ctx); spanContext.IsValid() {
+		record.AddAttrs(slog.String("traceId", spanContext.TraceID().String()), slog.String("spanId", spanContext.SpanID().String()))
+	}
+	return h.Handler.Handle(ctx, record)
+}
+
+func (h contextHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return contextHandler{h.Handler.WithAttrs(attrs)}
+}
+
+func (h contextHandler) WithGroup(name string) slog.Handler {
+	return contextHandler{h.Handler.WithGroup(name)}
+}
+
+// Middleware that takes the X-Request-ID header or generates one, echoes it in the response
+// and puts it into the request context for every log line of the request
+func requestIdMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		requestId := c.GetHeader(REQUEST_ID_HEADER)
+		if !requestIdPattern.MatchString(requestId) {
+			generated, err := generateUUID()
+			if err != nil {
+				generated = "unknown"
+			}
+			requestId = generated
+		}
+
+		c.Header(REQUEST_ID_HEADER, requestId)
+		c.Request = c.Request.WithContext(withRequestId(c.Request.Context(), requestId))
+		c.Next()
+	}
+}
+
+// Access log with the route template instead of the raw path, so requests can be grouped
+// by endpoint. Server errors are logged as errors and client errors as warnings, successful
+// probes only at debug level.
+func accessLogMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		start := time.Now()
+		c.Next()
+
+		route := c.FullPath()
+		if route == "" {
+			route = "unmatched"
+		}
+
+		status := c.Writer.Status()
+		level := slog.LevelInfo
+		switch {
+		case status >= http.StatusInternalServerError:
+			level = slog.LevelError
+		case status >= http.StatusBadRequest:
+			level = slog.LevelWarn
+		case slices.Contains(probeRoutes, route):
+			level = slog.LevelDebug
+		}
+
+		attrs := []slog.Attr{
+			slog.String("method", c.Request.Method),
+			slog.String("route", route),
+			slog.String("path", c.Request.URL.Path),
+			slog.Int("status", status),
+			slog.Float64("latencyMs", float64(time.Since(start).Microseconds())/1000),
+			slog.Int("bytes", max(c.Writer.Size(), 0)),
+			slog.String("clientIp", c.ClientIP()),
+			slog.String("userAgent", c.Request.UserAgent()),
+		}
+		if len(c.Errors) > 0 {
+			attrs = append(attrs, slog.String("errors", c.Errors.String()))
+		}
+
+		slog.LogAttrs(c.Request.Context(), level, "request", attrs...)
+	}
+}
+
+// Like gin.Recovery but the panic is logged through slog with the request id
+func recoveryMiddleware() gin.HandlerFunc {
+	return gin.CustomRecoveryWithWriter(io.Discard, func(c *gin.Context, recovered any) {
+		slog.ErrorContext(c.Request.Context(), "Panic while handling request", "panic", recovered, "stack", string(debug.Stack()))
+		respondError(c, fmt.Errorf("panic: %v", recovered))
+	})
+}
@@ -1,52 +1,107 @@
 package main
 
 import (
-	"fmt"
-	"log"
+	"context"
+	"errors"
+	"flag"
+	"log/slog"
 	"net/http"
 	"os"
-	"path/filepath"
-	"strconv"
-	"strings"
+	"os/signal"
+	"syscall"
 
+	"github.com/AJ-Walker/movies-rest-api/config"
 	"github.com/gin-gonic/gin"
-	"github.com/joho/godotenv"
 )
 
+// Settings loaded from defaults, the config file, env and flags, see the config package
+var appConfig = config.Defaults()
+
 type Movie struct {
-	MovieId          int     `json:"movieId"`
-	Title            string  `json:"title"`
-	ReleaseYear      uint16  `json:"releaseYear"`
-	Genre            string  `json:"genre"`
-	CoverUrl         *string `json:"coverUrl"`
-	GeneratedSummary *string `json:"generatedSummary"`
+	MovieId     int     `json:"movieId"`
+	Title       string  `json:"title"`
+	ReleaseYear uint16  `json:"releaseYear"`
+	Genre       string  `json:"genre"`
+	CoverKey    *string `json:"coverKey"`
+	CoverUrl    *string `json:"coverUrl"` // computed from CoverKey, not stored
+	// resized copies of the cover for srcset, keyed by variant name (thumbnail, medium, large)
+	CoverVariants    map[string]CoverVariant `json:"coverVariants"`
+	CoverVariantKeys map[string]CoverVariant `json:"-"`
+	// gallery, only filled when fetching a single movie
+	Images           []MovieImage `json:"images,omitempty"`
+	GeneratedSummary *string      `json:"generatedSummary"`
+	ContentAdvisory  *string      `json:"contentAdvisory"`
+	CoverAltText     *string      `json:"coverAltText"`
+	CoverDescription *string      `json:"coverDescription"`
+	SummaryModelId   *string      `json:"summaryModelId"`
 	// GeneratedSummary null.String `json:"generatedSummary,omitempty"`
 }
 
 func main() {
-	// Set log flags (adds timestamp)
-	log.SetFlags(log.Ldate | log.Ltime | log.Lshortfile)
+	// flags come before the command, e.g. `go run . -config config.yaml -listen-addr :9090 migrate`
+	cfg, args, err := config.Load(os.Args[1:])
+	if errors.Is(err, flag.ErrHelp) {
+		os.Exit(0)
+	}
+	if err != nil {
+		logFatal("Cannot load configuration", "error", err)
+	}
+	appConfig = cfg
+
+	// JSON logs at LOG_LEVEL from here on
+	InitLogger()
+
+	// one-off commands, e.g. `go run . config`
+	if len(args) > 0 && !commandNeedsDB(args[0]) {
+		os.Exit(runCommand(args[0], args[1:]))
+	}
+
+	if err := appConfig.Validate(); err != nil {
+		logFatal("Invalid configuration", "error", err)
+	}
 
-	// load environement variables
-	if err := godotenv.Load(); err != nil {
-		log.Fatalf("Cannot load environment variables. Error occured: %v", err)
+	// before the AWS clients, their calls are traced with the tracer set up here
+	if err := InitTracing(context.Background()); err != nil {
+		logFatal("Cannot set up tracing", "error", err)
 	}
 
 	// Initialize AWS clients
 	InitAWSClients()
+	InitGenerator()
 
-	db_password, err := GetSecretByKey(os.Getenv("SECRET_ARN"), os.Getenv("DB_SECRET_KEY"))
-	if err != nil {
-		log.Fatalf("%s", err.Error())
-	}
+	// the DB password comes from DB_PASSWORD by default, see SECRETS_PROVIDER
+	InitSecrets()
 
 	// DB connect and ping
-	if err := DBConnectAndPing(db_password); err != nil {
-		log.Fatal(err)
+	if err := DBConnectAndPing(); err != nil {
+		logFatal("Cannot connect to the DB", "error", err)
+	}
+
+	// Initialize router, every log line of a request carries its X-Request-ID
+	router := gin.New()
+	router.Use(tracingMiddleware(), requestIdMiddleware(), metricsMiddleware(), accessLogMiddleware(), recoveryMiddleware())
+
+	// Initialize the blob store for cover images
+	InitBlobStore(router)
+
+	// commands that need the DB and blob store, e.g. `go run . migrate`
+	if len(args) > 0 {
+		code := runCommand(args[0], args[1:])
+		shutdownTracing(context.Background())
+		os.Exit(code)
 	}
 
-	// Initialize router
-	router := gin.Default()
+	// canceled on SIGINT or SIGTERM
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	// a second signal kills the process right away
+	context.AfterFunc(ctx, stop)
+
+	// periodic orphaned object cleanup, off unless configured
+	startStorageGC(ctx)
+
+	// DB, blob store and generator checks for /readyz
+	registerHealthChecks()
 
 	// Set a lower memory limit for multipart forms (default is 32 MiB)
 	router.MaxMultipartMemory = 10 << 20 // 10 MiB
@@ -61,42 +116,83 @@ func main() {
 			moviesGroup.PUT("/:movieId", updateMovie)
 			moviesGroup.DELETE("/:movieId", deleteMovie)
 			moviesGroup.GET("/:movieId/summary", getMovieSummary)
+			moviesGroup.POST("/:movieId/chat", createChatSession)
+			moviesGroup.PUT("/:movieId/cover", replaceMovieCover)
+			moviesGroup.DELETE("/:movieId/cover", deleteMovieCover)
+			moviesGroup.POST("/:movieId/cover/upload-url", createCoverUploadUrl)
+			moviesGroup.POST("/:movieId/cover/confirm", confirmCoverUpload)
+			moviesGroup.POST("/:movieId/cover/alt-text/generate", regenerateCoverAltText)
+			moviesGroup.PUT("/:movieId/cover/alt-text", updateCoverAltText)
+			moviesGroup.GET("/:movieId/images", getMovieImages)
+			moviesGroup.POST("/:movieId/images", addMovieImage)
+			moviesGroup.PUT("/:movieId/images/order", reorderMovieImages)
+			moviesGroup.POST("/:movieId/images/:imageId/primary", setPrimaryMovieImage)
+			moviesGroup.DELETE("/:movieId/images/:imageId", deleteMovieImage)
+			moviesGroup.POST("/:movieId/tags/suggest", suggestMovieTags)
+			moviesGroup.GET("/:movieId/tags/suggestions", getTagSuggestions)
+			moviesGroup.POST("/:movieId/tags/suggestions/:suggestionId/accept", acceptTagSuggestion)
+			moviesGroup.POST("/:movieId/tags/suggestions/:suggestionId/reject", rejectTagSuggestion)
+		}
+
+		// image proxy, used for cover urls with COVER_DELIVERY=proxy or redirect
+		apiGroup.GET("/images/*key", getImage)
+		apiGroup.HEAD("/images/*key", getImage)
+
+		chatGroup := apiGroup.Group("/chat")
+		{
+			chatGroup.GET("/:sessionId", getChatSession)
+			chatGroup.DELETE("/:sessionId", deleteChatSession)
+			chatGroup.POST("/:sessionId/messages", sendChatMessage)
 		}
 	}
 
-	// healthcheck route
-	router.GET("/healthcheck", healthcheck)
+	adminGroup := apiGroup.Group("/admin")
+	{
+		adminGroup.GET("/llm-usage", getLLMUsage)
+		adminGroup.GET("/summary-reviews", getSummaryReviews)
+		adminGroup.POST("/summary-reviews/:reviewId/approve", approveSummaryReview)
+		adminGroup.POST("/summary-reviews/:reviewId/reject", rejectSummaryReview)
+		adminGroup.GET("/storage/reconcile", getStorageReconcileReport)
+	}
 
-	router.Run("localhost:8080") // listen and serve on localhost:8080
-}
+	// liveness and dependency-aware readiness, /healthcheck is kept for existing monitors
+	router.GET("/livez", livez)
+	router.GET("/readyz", readyz)
+	router.GET("/healthcheck", livez)
 
-// Handler for /api/healthcheck
-func healthcheck(c *gin.Context) {
-	log.Print("Inside healthcheck")
-	c.JSON(http.StatusOK, gin.H{"status": "ok"})
+	// Prometheus metrics
+	router.GET("/metrics", metricsHandler())
+
+	// unknown routes get a problem details body like every other error
+	router.NoRoute(func(c *gin.Context) {
+		respondError(c, newError(ErrNotFound, "route not found"))
+	})
+
+	// listen and serve until a shutdown signal, localhost:8080 by default
+	runServer(ctx, router)
 }
 
 func getMovies(c *gin.Context) {
-	log.Print("Inside getMovies func")
+	slog.DebugContext(c.Request.Context(), "Inside getMovies func")
 
-	log.Printf("Query: year = %v", c.Query("year"))
+	slog.DebugContext(c.Request.Context(), "Query", "year", c.Query("year"))
 
 	var result []Movie
 	var err error
 	if c.Query("year") == "" {
-		result, err = GetAllMovies_DB()
+		result, err = GetAllMovies_DB(c.Request.Context())
 	} else {
-		result, err = GetMoviesByYear_DB(c.Query("year"))
+		result, err = GetMoviesByYear_DB(c.Request.Context(), c.Query("year"))
 	}
 
 	if err != nil {
-		log.Print(err)
-		c.JSON(http.StatusBadRequest, response(http.StatusBadRequest, false, err.Error(), nil))
+		slog.WarnContext(c.Request.Context(), "Error fetching movies", "error", err)
+		respondError(c, err)
 		return
 	}
 
 	if len(result) == 0 {
-		c.JSON(http.StatusNotFound, response(http.StatusNotFound, false, "No movies found", nil))
+		respondError(c, newError(ErrNotFound, "no movies found"))
 		return
 	}
 
@@ -104,39 +200,52 @@ func getMovies(c *gin.Context) {
 }
 
 func getMovieSummary(c *gin.Context) {
-	log.Print("Inside getMovieSummary func")
+	slog.DebugContext(c.Request.Context(), "Inside getMovieSummary func")
 
 	movieId := c.Param("movieId")
 	if movieId == "" {
-		c.JSON(http.StatusBadRequest, response(http.StatusBadRequest, false, "MovieId cannot be empty", nil))
+		respondError(c, invalidField("movieId", "cannot be empty"))
 		return
 	}
 
-	result, err := GetMovieSummary_DB(movieId)
+	movie, err := GetMovieSummary_DB(c.Request.Context(), movieId, llmUser(c))
+	if errors.Is(err, ErrSummaryPendingReview) {
+		c.JSON(http.StatusAccepted, response(http.StatusAccepted, false, "Summary is waiting for editor review", nil))
+		return
+	}
+	// budget exhaustion is cached-only mode, summaries that were generated before are still served
 	if err != nil {
-		c.JSON(http.StatusBadRequest, response(http.StatusBadRequest, false, err.Error(), nil))
+		respondError(c, err)
 		return
 	}
 
-	data := map[string]string{
-		"summary": result,
+	data := map[string]any{
+		"summary": movie.GeneratedSummary,
+		// which model produced the summary, null for summaries generated before this was tracked
+		"modelId": movie.SummaryModelId,
 	}
 
 	c.JSON(http.StatusOK, response(http.StatusOK, true, "Movie summary fetched.", data))
 }
 
 func getMovieById(c *gin.Context) {
-	log.Print("Inside getMovieById func")
+	slog.DebugContext(c.Request.Context(), "Inside getMovieById func")
 
 	movieId := c.Param("movieId")
 	if movieId == "" {
-		c.JSON(http.StatusBadRequest, response(http.StatusBadRequest, false, "MovieId cannot be empty", nil))
+		respondError(c, invalidField("movieId", "cannot be empty"))
+		return
+	}
+
+	result, err := GetMovieById_DB(c.Request.Context(), movieId)
+	if err != nil {
+		respondError(c, err)
 		return
 	}
 
-	result, err := GetMovieById_DB(movieId)
+	result.Images, err = GetMovieImages_DB(c.Request.Context(), result.MovieId)
 	if err != nil {
-		c.JSON(http.StatusBadRequest, response(http.StatusBadRequest, false, err.Error(), nil))
+		respondError(c, err)
 		return
 	}
 
@@ -144,75 +253,59 @@ func getMovieById(c *gin.Context) {
 }
 
 func addMovie(c *gin.Context) {
-	log.Print("Inside addMovie func")
+	slog.DebugContext(c.Request.Context(), "Inside addMovie func")
 
-	title := c.PostForm("title")
-	releaseYear := c.PostForm("releaseYear")
-	genre := c.PostForm("genre")
-
-	log.Printf("FormData: title = %v, releaseYear = %v, genre = %v", title, releaseYear, genre)
-
-	if title == "" || releaseYear == "" || genre == "" {
-		c.JSON(http.StatusBadRequest, response(http.StatusBadRequest, false, "'title' or 'releaseYear' or 'genre' field cannot be empty", nil))
-		return
-	}
-
-	// check if movie is being created with same title
-	result, _ := GetMovieByTitle_DB(title)
-
-	if strings.TrimSpace(strings.ToLower(result.Title)) == strings.TrimSpace(strings.ToLower(title)) {
-		log.Printf("Movie with same title already exists")
-		c.JSON(http.StatusBadRequest, response(http.StatusBadRequest, false, "movie with same title already exists", nil))
+	// validated before the upload so a bad field doesn't leave objects behind
+	movie, err := bindMovie(c)
+	if err != nil {
+		respondError(c, err)
 		return
 	}
 
-	var objectUrl string
+	var cover coverUpload
 
 	coverImage, _ := c.FormFile("coverImage")
 	if coverImage != nil {
-		log.Printf("Movie coverImage file provided, Filename: %v", coverImage.Filename)
+		slog.DebugContext(c.Request.Context(), "Movie coverImage file provided", "filename", coverImage.Filename)
 
-		fileExtension := filepath.Ext(coverImage.Filename)
 		uuid, err := generateUUID()
 		if err != nil {
-			c.JSON(http.StatusBadRequest, response(http.StatusBadRequest, false, "Error generating unique id", nil))
+			respondError(c, err)
 			return
 		}
 
-		// upload file to s3
-		key := fmt.Sprintf("%v%v", uuid, fileExtension)
-		log.Printf("object key: %v", key)
-
-		// var err error
-		objectUrl, err = PutObject_S3(coverImage, key)
+		// validate, re-encode and upload the cover and its variants to the blob store
+		cover, err = uploadCoverImage(c.Request.Context(), coverImage, uuid)
 
 		if err != nil {
-			c.JSON(http.StatusBadRequest, response(http.StatusBadRequest, false, err.Error(), nil))
+			respondError(c, err)
 			return
 		}
 
-		log.Printf("Object Url: %v", objectUrl)
+		slog.DebugContext(c.Request.Context(), "Cover uploaded", "key", cover.Key)
 	}
 
-	year, err := strconv.Atoi(releaseYear)
+	// the uploaded cover is deleted again if the insert fails
+	movieId, err := createMovie(c.Request.Context(), movie, cover)
 	if err != nil {
-		c.JSON(http.StatusBadRequest, response(http.StatusBadRequest, false, "Error converting string to int", nil))
+		respondError(c, err)
 		return
 	}
 
-	movie := Movie{
-		Title:       title,
-		ReleaseYear: uint16(year),
-		Genre:       genre,
-	}
+	movie.MovieId = movieId
 
-	if objectUrl != "" {
-		movie.CoverUrl = &objectUrl
+	if coverImage != nil {
+		generateCoverAltTextAsync(c.Request.Context(), movie, cover, llmUser(c))
 	}
 
-	if err := AddMovie_DB(movie); err != nil {
-		c.JSON(http.StatusBadRequest, response(http.StatusBadRequest, false, err.Error(), nil))
-		return
+	// optional enrichment step, suggestions are reviewed by editors later
+	if c.PostForm("autoTag") == "true" {
+		userId := llmUser(c)
+		runInBackground(c.Request.Context(), "tag_suggestions", func(ctx context.Context) {
+			if _, err := SuggestMovieTags(ctx, movie, userId); err != nil {
+				slog.ErrorContext(ctx, "Error suggesting tags", "movieId", movieId, "error", err)
+			}
+		})
 	}
 
 	c.JSON(http.StatusOK, response(http.StatusOK, true, "Movie added successfully", nil))
@@ -221,92 +314,64 @@ func addMovie(c *gin.Context) {
 }
 
 func updateMovie(c *gin.Context) {
-	log.Print("Inside updateMovie func")
+	slog.DebugContext(c.Request.Context(), "Inside updateMovie func")
 
 	movieId := c.Param("movieId")
 	if movieId == "" {
-		c.JSON(http.StatusBadRequest, response(http.StatusBadRequest, false, "MovieId cannot be empty", nil))
+		respondError(c, invalidField("movieId", "cannot be empty"))
 		return
 	}
 
-	title := c.PostForm("title")
-	releaseYear := c.PostForm("releaseYear")
-	genre := c.PostForm("genre")
-
-	log.Printf("FormData: title = %v, releaseYear = %v, genre = %v", title, releaseYear, genre)
-
-	if title == "" || releaseYear == "" || genre == "" {
-		c.JSON(http.StatusBadRequest, response(http.StatusBadRequest, false, "'title' or 'releaseYear' or 'genre' field cannot be empty", nil))
+	// validated before the upload so a bad field doesn't leave objects behind
+	update, err := bindMovie(c)
+	if err != nil {
+		respondError(c, err)
 		return
 	}
 
 	// Check if movie exists with the provided movieId
-	movie, err := GetMovieById_DB(movieId)
+	movie, err := GetMovieById_DB(c.Request.Context(), movieId)
 	if err != nil {
-		c.JSON(http.StatusBadRequest, response(http.StatusBadRequest, false, err.Error(), nil))
+		respondError(c, err)
 		return
 	}
 
-	log.Print(movie)
-
-	if strings.TrimSpace(strings.ToLower(movie.Title)) != strings.TrimSpace(strings.ToLower(title)) {
-		// check if movie is being created with same title
-		result, _ := GetMovieByTitle_DB(title)
-
-		if strings.TrimSpace(strings.ToLower(result.Title)) == strings.TrimSpace(strings.ToLower(title)) {
-			log.Printf("Movie with same title already exists")
-			c.JSON(http.StatusBadRequest, response(http.StatusBadRequest, false, "movie with same title already exists", nil))
-			return
-		}
-	}
+	slog.DebugContext(c.Request.Context(), "Existing movie", "movie", movie)
 
-	var objectUrl string
+	var cover coverUpload
 
 	coverImage, _ := c.FormFile("coverImage")
 	if coverImage != nil {
-		log.Printf("Movie coverImage file provided, Filename: %v", coverImage.Filename)
+		slog.DebugContext(c.Request.Context(), "Movie coverImage file provided", "filename", coverImage.Filename)
 
-		fileExtension := filepath.Ext(coverImage.Filename)
 		uuid, err := generateUUID()
 		if err != nil {
-			c.JSON(http.StatusBadRequest, response(http.StatusBadRequest, false, "Error generating unique id", nil))
+			respondError(c, err)
 			return
 		}
 
-		// upload file to s3
-		key := fmt.Sprintf("%v%v", uuid, fileExtension)
-		log.Printf("object key: %v", key)
-
-		// var err error
-		objectUrl, err = PutObject_S3(coverImage, key)
+		// validate, re-encode and upload the cover and its variants to the blob store
+		cover, err = uploadCoverImage(c.Request.Context(), coverImage, uuid)
 
 		if err != nil {
-			c.JSON(http.StatusBadRequest, response(http.StatusBadRequest, false, err.Error(), nil))
+			respondError(c, err)
 			return
 		}
 
-		log.Printf("Object Url: %v", objectUrl)
-	}
-
-	year, err := strconv.Atoi(releaseYear)
-	if err != nil {
-		c.JSON(http.StatusBadRequest, response(http.StatusBadRequest, false, "Error converting string to int", nil))
-		return
+		slog.DebugContext(c.Request.Context(), "Cover uploaded", "key", cover.Key)
 	}
 
-	movie = Movie{
-		Title:       title,
-		ReleaseYear: uint16(year),
-		Genre:       genre,
-	}
+	update.MovieId = movie.MovieId
+	movie = update
 
-	if objectUrl != "" {
-		movie.CoverUrl = &objectUrl
+	// a replaced cover is deleted only after the update has committed
+	if err := saveMovie(c.Request.Context(), movie.MovieId, movie, cover); err != nil {
+		respondError(c, err)
+		return
 	}
 
-	if err := UpdateMovieById_DB(movieId, movie); err != nil {
-		c.JSON(http.StatusBadRequest, response(http.StatusBadRequest, false, err.Error(), nil))
-		return
+	if coverImage != nil {
+		generateCoverAltTextAsync(c.Request.Context(), movie, cover, llmUser(c))
 	}
 
 	c.JSON(http.StatusOK, response(http.StatusOK, true, "Movie updated successfully", nil))
@@ -314,35 +379,26 @@ func updateMovie(c *gin.Context) {
 }
 
 func deleteMovie(c *gin.Context) {
-	log.Print("Inside deleteMovie func")
+	slog.DebugContext(c.Request.Context(), "Inside deleteMovie func")
 
 	movieId := c.Param("movieId")
 	if movieId == "" {
-		c.JSON(http.StatusBadRequest, response(http.StatusBadRequest, false, "MovieId cannot be empty", nil))
+		respondError(c, invalidField("movieId", "cannot be empty"))
 		return
 	}
 
 	// Check if movie exists with the provided movieId
-	movie, err := GetMovieById_DB(movieId)
+	movie, err := GetMovieById_DB(c.Request.Context(), movieId)
 	if err != nil {
-		c.JSON(http.StatusBadRequest, response(http.StatusBadRequest, false, err.Error(), nil))
+		respondError(c, err)
 		return
 	}
 
-	if err := DeleteMovieById_DB(movieId); err != nil {
-		c.JSON(http.StatusBadRequest, response(http.StatusBadRequest, false, err.Error(), nil))
+	// cover and gallery objects are deleted after the row is gone
+	if err := removeMovie(c.Request.Context(), movie.MovieId); err != nil {
+		respondError(c, err)
 		return
 	}
 
-	if movie.CoverUrl != nil || *movie.CoverUrl != "" {
-		splittedString := strings.Split(*movie.CoverUrl, "/")
-
-		objectKey := splittedString[len(splittedString)-1]
-		log.Printf("ObjectKey: %v", objectKey)
-		if err := DeleteObject_S3(objectKey); err != nil {
-			log.Printf("Error while deleting object: %v", err)
-		}
-	}
-
 	c.JSON(http.StatusOK, response(http.StatusOK, true, "Movie deleted successfully", nil))
 }
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"io"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const METRICS_NAMESPACE string = "movies_api"
+
+// Own registry instead of the global default one, so tests can gather exactly what the API
+// exports, e.g. with testutil.ToFloat64(metrics.summaryCache.WithLabelValues("hit"))
+var metricsRegistry = prometheus.NewRegistry()
+
+var metrics = newAppMetrics(metricsRegistry)
+
+type appMetrics struct {
+	httpDuration *prometheus.HistogramVec
+	httpInFlight prometheus.Gauge
+
+	blobDuration *prometheus.HistogramVec
+	blobFailures *prometheus.CounterVec
+
+	llmCalls    *prometheus.CounterVec
+	llmTokens   *prometheus.CounterVec
+	llmDuration *prometheus.HistogramVec
+
+	// hit ratio = hit / (hit + miss)
+	summaryCache   *prometheus.CounterVec
+	backgroundJobs prometheus.Gauge
+}
+
+func newAppMetrics(registry *prometheus.Registry) *appMetrics {
+	m := &appMetrics{
+		httpDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: METRICS_NAMESPACE,
+			Name:      "http_request_duration_seconds",
+			Help:      "Duration of HTTP requests by route template and status.",
+			Buckets:   prometheus.DefBuckets,
+		}, []string{"method", "route", "status"}),
+		httpInFlight: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: METRICS_NAMESPACE,
+			Name:      "http_requests_in_flight",
+			Help:      "HTTP requests currently being served.",
+		}),
+		blobDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: METRICS_NAMESPACE,
+			Name:      "blob_operation_duration_seconds",
+			Help:      "Duration of blob store operations, e.g. S3 puts and deletes.",
+			Buckets:   []float64{.01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10, 30},
+		}, []string{"backend", "operation"}),
+		blobFailures: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: METRICS_NAMESPACE,
+			Name:      "blob_operation_failures_total",
+			Help:      "Failed blob store operations, a missing object is not a failure.",
+		}, []string{"backend", "operation"}),
+		llmCalls: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: METRICS_NAMESPACE,
+			Name:      "llm_calls_total",
+			Help:      "Model calls by operation, model and result.",
+		}, []string{"operation", "model", "result"}),
+		llmTokens: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: METRICS_NAMESPACE,
+			Name:      "llm_tokens_total",
+			Help:      "Tokens used by model calls, by direction (input or output).",
+		}, []string{"operation", "model", "direction"}),
+		llmDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: METRICS_NAMESPACE,
+			Name:      "llm_call_duration_seconds",
+			Help:      "Duration of model calls, including retries and fallbacks.",
+			Buckets:   []float64{.25, .5, 1, 2.5, 5, 10, 20, 30, 60, 120},
+		}, []string{"operation", "model"}),
+		summaryCache: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: METRICS_NAMESPACE,
+			Name:      "summary_cache_requests_total",
+			Help:      "Summary requests served from the DB (hit) or generated (miss).",
+		}, []string{"result"}),
+		backgroundJobs: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: METRICS_NAMESPACE,
+			Name:      "background_jobs",
+			Help:      "Background jobs queued or running, e.g. alt text generation and tag suggestions.",
+		}),
+	}
+
+	registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		m.httpDuration, m.httpInFlight,
+		m.blobDuration, m.blobFailures,
+		m.llmCalls, m.llmTokens, m.llmDuration,
+		m.summaryCache, m.backgroundJobs,
+	)
+
+	return m
+}
+
+// Export the connection pool stats of the DB (open, in use, idle, wait count and duration)
+func registerDBMetrics(db *sql.DB, dbName string) {
+	metricsRegistry.MustRegister(collectors.NewDBStatsCollector(db, dbName))
+}
+
+// Handler for GET /metrics in the Prometheus text format
+func metricsHandler() gin.HandlerFunc {
+	return gin.WrapH(promhttp.HandlerFor(metricsRegistry, promhttp.HandlerOpts{Registry: metricsRegistry}))
+}
+
+// Middleware recording the duration of every request by route template, not raw path, so
+// /api/movies/1 and /api/movies/2 are one series
+func metricsMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		start := time.Now()
+		metrics.httpInFlight.Inc()
+		defer metrics.httpInFlight.Dec()
+
+		c.Next()
+
+		route := c.FullPath()
+		if route == "" {
+			route = "unmatched"
+		}
+		metrics.httpDuration.WithLabelValues(c.Request.Method, route, strconv.Itoa(c.Writer.Status())).Observe(time.Since(start).Seconds())
+	}
+}
+
+func (m *appMetrics) observeLLMCall(operation string, modelId string, inputTokens int, outputTokens int, latency time.Duration, err error) {
+	result := "ok"
+	if err != nil {
+		result = "error"
+	}
+
+	m.llmCalls.WithLabelValues(operation, modelId, result).Inc()
+	m.llmTokens.WithLabelValues(operation, modelId, "input").Add(float64(inputTokens))
+	m.llmTokens.WithLabelValues(operation, modelId, "output").Add(float64(outputTokens))
+	m.llmDuration.WithLabelValues(operation, modelId).Observe(latency.Seconds())
+}
+
+// instrumentedBlobStore records the latency and failures of every operation of a blob store
+type instrumentedBlobStore struct {
+	BlobStore
+	backend string
+}
+
+func (s instrumentedBlobStore) observe(operation string, start time.Time, err error) {
+	metrics.blobDuration.WithLabelValues(s.backend, operation).Observe(time.Since(start).Seconds())
+	if err != nil && !errors.Is(err, ErrObjectNotFound) {
+		metrics.blobFailures.WithLabelValues(s.backend, operation).Inc()
+	}
+}
+
+func (s instrumentedBlobStore) Put(ctx context.Context, key string, body io.Reader, size int64, contentType string) error {
+	start := time.Now()
+	err := s.BlobStore.Put(ctx, key, body, size, contentType)
+	s.observe("put", start, err)
+	return err
+}
+
+func (s instrumentedBlobStore) Get(ctx context.Context, key string) (io.ReadCloser, ObjectInfo, error) {
+	start := time.Now()
+	body, info, err := s.BlobStore.Get(ctx, key)
+	s.observe("get", start, err)
+	return body, info, err
+}
+
+func (s instrumentedBlobStore) Open(ctx context.Context, key string) (io.ReadSeekCloser, ObjectInfo, error) {
+	start := time.Now()
+	reader, info, err := s.BlobStore.Open(ctx, key)
+	s.observe("open", start, err)
+	return reader, info, err
+}
+
+func (s instrumentedBlobStore) Delete(ctx context.Context, key string) error {
+	start := time.Now()
+	err := s.BlobStore.Delete(ctx, key)
+	s.observe("delete", start, err)
+	return err
+}
+
+func (s instrumentedBlobStore) Head(ctx context.Context, key string) (ObjectInfo, error) {
+	start := time.Now()
+	info, err := s.BlobStore.Head(ctx, key)
+	s.observe("head", start, err)
+	return info, err
+}
+
+func (s instrumentedBlobStore) List(ctx context.Context, prefix string) ([]ObjectInfo, error) {
+	start := time.Now()
+	objects, err := s.BlobStore.List(ctx, prefix)
+	s.observe("list", start, err)
+	return objects, err
+}
+
+func (s instrumentedBlobStore) PresignPut(ctx context.Context, key string, contentType string, size int64, expires time.Duration) (PresignedUpload, error) {
+	start := time.Now()
+	upload, err := s.BlobStore.PresignPut(ctx, key, contentType, size, expires)
+	s.observe("presign_put", start, err)
+	return upload, err
+}
+
+func (s instrumentedBlobStore) PresignGet(ctx context.Context, key string, expires time.Duration) (string, error) {
+	start := time.Now()
+	url, err := s.BlobStore.PresignGet(ctx, key, expires)
+	s.observe("presign_get", start, err)
+	return url, err
+}
+
+func (s instrumentedBlobStore) Ping(ctx context.Context) error {
+	start := time.Now()
+	err := s.BlobStore.Ping(ctx)
+	s.observe("ping", start, err)
+	return err
+}
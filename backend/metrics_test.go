@@ -0,0 +1,116 @@
+package main
+
+import (
+	"context"
+	"database/sql/driver"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// Fresh metrics on their own registry for the rest of the test
+func useTestMetrics(t *testing.T) *prometheus.Registry {
+	t.Helper()
+
+	registry := prometheus.NewRegistry()
+	previous := metrics
+	metrics = newAppMetrics(registry)
+	t.Cleanup(func() { metrics = previous })
+
+	return registry
+}
+
+func TestHTTPDurationLabels(t *testing.T) {
+	registry := useTestMetrics(t)
+
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.Use(metricsMiddleware())
+	router.GET("/api/movies/:movieId", func(c *gin.Context) { c.Status(http.StatusOK) })
+
+	for _, path := range []string{"/api/movies/1", "/api/movies/2", "/api/movies/3/unknown"} {
+		router.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, path, nil))
+	}
+
+	// one series per route template, never per raw path
+	tests := []struct {
+		route  string
+		status string
+		count  uint64
+	}{
+		{"/api/movies/:movieId", "200", 2},
+		{"unmatched", "404", 1},
+	}
+
+	if series := testutil.CollectAndCount(metrics.httpDuration); series != len(tests) {
+		t.Errorf("expected %d series, got %d", len(tests), series)
+	}
+
+	families, err := registry.Gather()
+	if err != nil {
+		t.Fatalf("cannot gather metrics: %v", err)
+	}
+
+	counts := map[[3]string]uint64{}
+	for _, family := range families {
+		if family.GetName() != METRICS_NAMESPACE+"_http_request_duration_seconds" {
+			continue
+		}
+		for _, metric := range family.GetMetric() {
+			labels := map[string]string{}
+			for _, label := range metric.GetLabel() {
+				labels[label.GetName()] = label.GetValue()
+			}
+			counts[[3]string{labels["method"], labels["route"], labels["status"]}] = metric.GetHistogram().GetSampleCount()
+		}
+	}
+
+	for _, test := range tests {
+		if got := counts[[3]string{http.MethodGet, test.route, test.status}]; got != test.count {
+			t.Errorf("route %v status %v: expected %d requests, got %d", test.route, test.status, test.count, got)
+		}
+	}
+}
+
+func TestSummaryCacheCounters(t *testing.T) {
+	useTestMetrics(t)
+	state := useFaultDB(t)
+
+	previousGenerator := Generator
+	Generator = fakeGenerator{}
+	t.Cleanup(func() { Generator = previousGenerator })
+
+	summary := "A stored summary."
+	tests := []struct {
+		name    string
+		summary any
+		hits    float64
+		misses  float64
+	}{
+		{"stored summary is a hit", summary, 1, 0},
+		{"missing summary is a miss", nil, 1, 1},
+		{"empty summary is a miss", "", 1, 2},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			state.reset()
+			state.rows["SELECT "+movieColumns] = [][]driver.Value{{int64(1), "Check", int64(2000), "Drama", nil, nil, test.summary, nil, nil, nil, nil}}
+			state.rows["SELECT COUNT(*) FROM summary_reviews"] = [][]driver.Value{{int64(0)}}
+
+			// the fake summary is short and goes to review, the miss is counted anyway
+			GetMovieSummary_DB(context.Background(), "1", "test")
+
+			if hits := testutil.ToFloat64(metrics.summaryCache.WithLabelValues("hit")); hits != test.hits {
+				t.Errorf("expected %v hits, got %v", test.hits, hits)
+			}
+			if misses := testutil.ToFloat64(metrics.summaryCache.WithLabelValues("miss")); misses != test.misses {
+				t.Errorf("expected %v misses, got %v", test.misses, misses)
+			}
+		})
+	}
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"context"
+	"embed"
+	"errors"
+	"fmt"
+	"log/slog"
+	"slices"
+	"sort"
+	"strings"
+
+	"github.com/go-sql-driver/mysql"
+)
+
+// Schema changes for existing databases, applied in file name order.
+// scripts.sql always holds the full current schema for new databases.
+//
+// MySQL commits DDL implicitly, so a migration can't run in a transaction. Instead every
+// statement is recorded in schema_migration_steps once it ran, and a migration that failed
+// halfway continues after its last applied statement on the next run.
+//
+//go:embed migrations/*.sql
+var migrationFiles embed.FS
+
+// Apply the migrations that are not recorded in schema_migrations yet
+func RunMigrations_DB(ctx context.Context) ([]string, error) {
+	slog.DebugContext(ctx, "Inside RunMigrations_DB func")
+
+	if _, err := db.ExecContext(ctx, "CREATE TABLE IF NOT EXISTS schema_migrations (version VARCHAR(100) PRIMARY KEY, appliedAt TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP)"); err != nil {
+		return nil, fmt.Errorf("RunMigrations_DB error: %v", err)
+	}
+	if _, err := db.ExecContext(ctx, "CREATE TABLE IF NOT EXISTS schema_migration_steps (version VARCHAR(100) NOT NULL, step INT NOT NULL, PRIMARY KEY (version, step))"); err != nil {
+		return nil, fmt.Errorf("RunMigrations_DB error: %v", err)
+	}
+
+	entries, err := migrationFiles.ReadDir("migrations")
+	if err != nil {
+		return nil, fmt.Errorf("RunMigrations_DB error: %v", err)
+	}
+
+	var names []string
+	for _, entry := range entries {
+		names = append(names, entry.Name())
+	}
+	sort.Strings(names)
+
+	applied := []string{}
+	for _, name := range names {
+		version := strings.TrimSuffix(name, ".sql")
+
+		var count int
+		if err := db.QueryRowContext(ctx, "SELECT COUNT(*) FROM schema_migrations WHERE version = ?", version).Scan(&count); err != nil {
+			return applied, fmt.Errorf("RunMigrations_DB error: %v", err)
+		}
+		if count > 0 {
+			continue
+		}
+
+		script, err := migrationFiles.ReadFile("migrations/" + name)
+		if err != nil {
+			return applied, fmt.Errorf("RunMigrations_DB error: %v", err)
+		}
+
+		slog.InfoContext(ctx, "Applying migration", "version", version)
+		if err := applyMigrationSteps_DB(ctx, version, splitStatements(string(script))); err != nil {
+			return applied, err
+		}
+
+		if _, err := db.ExecContext(ctx, "INSERT INTO schema_migrations (version) VALUES (?)", version); err != nil {
+			return applied, fmt.Errorf("RunMigrations_DB error: %v", err)
+		}
+		if _, err := db.ExecContext(ctx, "DELETE FROM schema_migration_steps WHERE version = ?", version); err != nil {
+			return applied, fmt.Errorf("RunMigrations_DB error: %v", err)
+		}
+
+		applied = append(applied, version)
+	}
+
+	return applied, nil
+}
+
+// MySQL errors of DDL whose change is already there, e.g. from a database created with an
+// older scripts.sql: table exists, duplicate column and duplicate key name
+var alreadyAppliedErrors = []uint16{1050, 1060, 1061}
+
+// Run the statements of a migration that haven't run yet, recording each one as it succeeds
+func applyMigrationSteps_DB(ctx context.Context, version string, statements []string) error {
+	rows, err := db.QueryContext(ctx, "SELECT step FROM schema_migration_steps WHERE version = ?", version)
+	if err != nil {
+		return fmt.Errorf("applyMigrationSteps_DB error: %v", err)
+	}
+	done := map[int]bool{}
+	for rows.Next() {
+		var step int
+		if err := rows.Scan(&step); err != nil {
+			rows.Close()
+			return fmt.Errorf("applyMigrationSteps_DB error: %v", err)
+		}
+		done[step] = true
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("applyMigrationSteps_DB error: %v", err)
+	}
+
+	for step, statement := range statements {
+		if done[step] {
+			slog.InfoContext(ctx, "Skipping applied migration step", "version", version, "step", step)
+			continue
+		}
+
+		if _, err := db.ExecContext(ctx, statement); err != nil {
+			var mysqlErr *mysql.MySQLError
+			if !errors.As(err, &mysqlErr) || !slices.Contains(alreadyAppliedErrors, mysqlErr.Number) {
+				return fmt.Errorf("applyMigrationSteps_DB error: migration %v step %d: %v", version, step, err)
+			}
+			slog.WarnContext(ctx, "Migration step already applied", "version", version, "step", step, "error", err)
+		}
+
+		if _, err := db.ExecContext(ctx, "INSERT INTO schema_migration_steps (version, step) VALUES (?, ?)", version, step); err != nil {
+			return fmt.Errorf("applyMigrationSteps_DB error: %v", err)
+		}
+	}
+
+	return nil
+}
+
+// Split a script into statements, dropping comment lines
+func splitStatements(script string) []string {
+	var lines []string
+	for _, line := range strings.Split(script, "\n") {
+		if !strings.HasPrefix(strings.TrimSpace(line), "--") {
+			lines = append(lines, line)
+		}
+	}
+
+	var statements []string
+	for _, statement := range strings.Split(strings.Join(lines, "\n"), ";") {
+		if statement = strings.TrimSpace(statement); statement != "" {
+			statements = append(statements, statement)
+		}
+	}
+
+	return statements
+}
@@ -0,0 +1,67 @@
+-- Schema of the chat, tagging, alt text, usage and summary review features, which was only
+-- in scripts.sql. Runs before 001 so databases created before those features can migrate.
+-- Databases created from a scripts.sql that already had them skip what exists.
+ALTER TABLE movie_details ADD COLUMN contentAdvisory VARCHAR(16);
+
+ALTER TABLE movie_details ADD COLUMN coverAltText VARCHAR(255);
+
+ALTER TABLE movie_details ADD COLUMN coverDescription TEXT;
+
+ALTER TABLE movie_details ADD COLUMN summaryModelId VARCHAR(100);
+
+CREATE TABLE IF NOT EXISTS chat_sessions (
+    sessionId CHAR(36) PRIMARY KEY,
+    movieId INT NOT NULL,
+    inputTokens INT NOT NULL DEFAULT 0,
+    outputTokens INT NOT NULL DEFAULT 0,
+    estimatedCost DECIMAL(12, 6) NOT NULL DEFAULT 0,
+    createdAt TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    FOREIGN KEY (movieId) REFERENCES movie_details(movieId) ON DELETE CASCADE
+);
+
+CREATE TABLE IF NOT EXISTS chat_messages (
+    messageId INT AUTO_INCREMENT PRIMARY KEY,
+    sessionId CHAR(36) NOT NULL,
+    role VARCHAR(16) NOT NULL,
+    content TEXT NOT NULL,
+    createdAt TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    FOREIGN KEY (sessionId) REFERENCES chat_sessions(sessionId) ON DELETE CASCADE
+);
+
+CREATE TABLE IF NOT EXISTS movie_tag_suggestions (
+    suggestionId INT AUTO_INCREMENT PRIMARY KEY,
+    movieId INT NOT NULL,
+    kind VARCHAR(16) NOT NULL,
+    value VARCHAR(100) NOT NULL,
+    status VARCHAR(16) NOT NULL DEFAULT 'pending',
+    createdAt TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    INDEX idx_movie_tag_suggestions_movie_status (movieId, status),
+    FOREIGN KEY (movieId) REFERENCES movie_details(movieId) ON DELETE CASCADE
+);
+
+CREATE TABLE IF NOT EXISTS llm_usage (
+    usageId BIGINT AUTO_INCREMENT PRIMARY KEY,
+    operation VARCHAR(32) NOT NULL,
+    modelId VARCHAR(100) NOT NULL,
+    userId VARCHAR(100) NOT NULL,
+    inputTokens INT NOT NULL DEFAULT 0,
+    outputTokens INT NOT NULL DEFAULT 0,
+    latencyMs INT NOT NULL,
+    estimatedCost DECIMAL(12, 6) NOT NULL DEFAULT 0,
+    success BOOLEAN NOT NULL,
+    createdAt TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    INDEX idx_llm_usage_created_at (createdAt)
+);
+
+CREATE TABLE IF NOT EXISTS summary_reviews (
+    reviewId INT AUTO_INCREMENT PRIMARY KEY,
+    movieId INT NOT NULL,
+    summary TEXT NOT NULL,
+    modelId VARCHAR(100) NOT NULL,
+    reasons JSON NOT NULL,
+    status VARCHAR(16) NOT NULL DEFAULT 'pending',
+    createdAt TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    reviewedAt TIMESTAMP NULL,
+    INDEX idx_summary_reviews_movie_status (movieId, status),
+    FOREIGN KEY (movieId) REFERENCES movie_details(movieId) ON DELETE CASCADE
+);
@@ -0,0 +1,14 @@
+-- Store the cover object key (e.g. images/<uuid>.jpg) instead of the full S3 url,
+-- the public url is built at response time
+ALTER TABLE movie_details ADD COLUMN coverKey VARCHAR(255) AFTER coverUrl;
+
+UPDATE movie_details
+SET coverKey = SUBSTRING(coverUrl, LOCATE('/images/', coverUrl) + 1)
+WHERE coverUrl LIKE '%/images/%';
+
+-- other urls keep everything after the host
+UPDATE movie_details
+SET coverKey = SUBSTRING(coverUrl, LOCATE('/', coverUrl, LOCATE('://', coverUrl) + 3) + 1)
+WHERE coverKey IS NULL AND coverUrl LIKE '%://%/%';
+
+ALTER TABLE movie_details DROP COLUMN coverUrl;
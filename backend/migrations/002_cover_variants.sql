@@ -0,0 +1,2 @@
+-- Object keys of the resized cover variants, covers uploaded before this have none
+ALTER TABLE movie_details ADD COLUMN coverVariants JSON AFTER coverKey;
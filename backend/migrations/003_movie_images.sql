@@ -0,0 +1,13 @@
+-- Image galleries: posters, backdrops and stills with ordering and a primary image
+CREATE TABLE movie_images (
+    imageId INT AUTO_INCREMENT PRIMARY KEY,
+    movieId INT NOT NULL,
+    kind VARCHAR(16) NOT NULL,
+    imageKey VARCHAR(255) NOT NULL,
+    variants JSON NOT NULL,
+    position INT NOT NULL DEFAULT 0,
+    isPrimary BOOLEAN NOT NULL DEFAULT FALSE,
+    createdAt TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    INDEX idx_movie_images_movie_position (movieId, position),
+    FOREIGN KEY (movieId) REFERENCES movie_details(movieId) ON DELETE CASCADE
+);
@@ -0,0 +1,30 @@
+-- One movie per normalized title and release year, remakes with another year are allowed
+ALTER TABLE movie_details ADD COLUMN normalizedTitle VARCHAR(255) AS (LOWER(TRIM(title))) STORED;
+
+-- Duplicates found while migrating, for editors to merge or delete. The oldest movie of
+-- each group keeps its title, the others are renamed so the unique index can be created.
+CREATE TABLE movie_title_conflicts (
+    movieId INT PRIMARY KEY,
+    keptMovieId INT NOT NULL,
+    originalTitle VARCHAR(255) NOT NULL,
+    releaseYear SMALLINT NOT NULL,
+    createdAt TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    FOREIGN KEY (movieId) REFERENCES movie_details(movieId) ON DELETE CASCADE
+);
+
+INSERT INTO movie_title_conflicts (movieId, keptMovieId, originalTitle, releaseYear)
+SELECT m.movieId, kept.movieId, m.title, m.releaseYear
+FROM movie_details m
+JOIN (
+    SELECT normalizedTitle, releaseYear, MIN(movieId) AS movieId
+    FROM movie_details
+    GROUP BY normalizedTitle, releaseYear
+    HAVING COUNT(*) > 1
+) kept ON kept.normalizedTitle = m.normalizedTitle AND kept.releaseYear = m.releaseYear
+WHERE m.movieId != kept.movieId;
+
+UPDATE movie_details m
+JOIN movie_title_conflicts c ON c.movieId = m.movieId
+SET m.title = CONCAT(LEFT(m.title, 240), ' (#', m.movieId, ')');
+
+CREATE UNIQUE INDEX uq_movie_details_title_year ON movie_details (normalizedTitle, releaseYear);
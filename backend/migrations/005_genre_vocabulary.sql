@@ -0,0 +1,17 @@
+-- Genres written before the vocabulary was enforced, mapped to their vocabulary spelling so
+-- the movies can be updated without changing their genres. Anything left outside the
+-- vocabulary is reported by the genre rule on the next update, with the allowed genres.
+
+-- one separator, "Crime/Drama" and "Crime ,Drama" become "Crime, Drama"
+UPDATE movie_details SET genre = REGEXP_REPLACE(TRIM(genre), '\\s*[,/|]\\s*', ', ');
+
+UPDATE movie_details SET genre = REGEXP_REPLACE(genre, '(^|, )(sci-fi|sci fi|scifi|science-fiction)(?=,|$)', '$1Science Fiction', 1, 0, 'i');
+UPDATE movie_details SET genre = REGEXP_REPLACE(genre, '(^|, )(animated|anime)(?=,|$)', '$1Animation', 1, 0, 'i');
+UPDATE movie_details SET genre = REGEXP_REPLACE(genre, '(^|, )(biopic|biographical)(?=,|$)', '$1Biography', 1, 0, 'i');
+UPDATE movie_details SET genre = REGEXP_REPLACE(genre, '(^|, )(historical|period)(?=,|$)', '$1History', 1, 0, 'i');
+UPDATE movie_details SET genre = REGEXP_REPLACE(genre, '(^|, )(romantic|romcom|rom-com)(?=,|$)', '$1Romance', 1, 0, 'i');
+UPDATE movie_details SET genre = REGEXP_REPLACE(genre, '(^|, )(sports)(?=,|$)', '$1Sport', 1, 0, 'i');
+UPDATE movie_details SET genre = REGEXP_REPLACE(genre, '(^|, )(music)(?=,|$)', '$1Musical', 1, 0, 'i');
+UPDATE movie_details SET genre = REGEXP_REPLACE(genre, '(^|, )(super hero|super-hero|superheroes)(?=,|$)', '$1Superhero', 1, 0, 'i');
+UPDATE movie_details SET genre = REGEXP_REPLACE(genre, '(^|, )(suspense)(?=,|$)', '$1Thriller', 1, 0, 'i');
+UPDATE movie_details SET genre = REGEXP_REPLACE(genre, '(^|, )(kids|children)(?=,|$)', '$1Family', 1, 0, 'i');
@@ -0,0 +1,312 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	SUMMARY_MIN_WORDS int = 40
+	SUMMARY_MAX_WORDS int = 160
+
+	REVIEW_STATUS_PENDING  string = "pending"
+	REVIEW_STATUS_APPROVED string = "approved"
+	REVIEW_STATUS_REJECTED string = "rejected"
+)
+
+var (
+	ErrSummaryPendingReview = errors.New("generated summary is waiting for editor review")
+	ErrSummaryReviewed      = newError(ErrConflict, "review was already approved or rejected")
+)
+
+type SummaryReview struct {
+	ReviewId   int        `json:"reviewId"`
+	MovieId    int        `json:"movieId"`
+	Summary    string     `json:"summary"`
+	ModelId    string     `json:"modelId"`
+	Reasons    []string   `json:"reasons"`
+	Status     string     `json:"status"`
+	CreatedAt  time.Time  `json:"createdAt"`
+	ReviewedAt *time.Time `json:"reviewedAt"`
+}
+
+var (
+	profanityPattern = regexp.MustCompile(`(?i)\b(fuck\w*|shit\w*|bitch\w*|bastard\w*|asshole\w*|cunt\w*|dick|motherfuck\w*|whore\w*|slut\w*)\b`)
+
+	emailPattern      = regexp.MustCompile(`(?i)\b[a-z0-9._%+-]+@[a-z0-9.-]+\.[a-z]{2,}\b`)
+	phonePattern      = regexp.MustCompile(`(\+\d{1,3}[\s.-]?)?\(?\d{3}\)?[\s.-]?\d{3}[\s.-]?\d{4}\b`)
+	cardNumberPattern = regexp.MustCompile(`\b(?:\d[ -]?){13,16}\b`)
+
+	spoilerPattern = regexp.MustCompile(`(?i)\b(in the end|at the end of the (film|movie)|the ending|final scene|plot twist|the twist|turns out to be|is revealed to be|reveals that|it is revealed|dies at the end|is killed by|ultimately dies|spoiler)\b`)
+
+	refusalPattern = regexp.MustCompile(`(?i)^\W*(i'm sorry|i am sorry|sorry,|i can't|i cannot|i can not|i'm unable|i am unable|i'm not able|as an ai|unfortunately, i)`)
+)
+
+// Run the post-generation checks on a summary and return why it was flagged, if at all
+func validateSummary(summary string) []string {
+	reasons := []string{}
+
+	if refusalPattern.MatchString(summary) {
+		reasons = append(reasons, "model refused or apologized instead of summarizing")
+	}
+
+	words := len(strings.Fields(summary))
+	if words < SUMMARY_MIN_WORDS {
+		reasons = append(reasons, fmt.Sprintf("too short: %d words, minimum is %d", words, SUMMARY_MIN_WORDS))
+	}
+	if words > SUMMARY_MAX_WORDS {
+		reasons = append(reasons, fmt.Sprintf("too long: %d words, maximum is %d", words, SUMMARY_MAX_WORDS))
+	}
+
+	if profanityPattern.MatchString(summary) {
+		reasons = append(reasons, "contains profanity")
+	}
+
+	if emailPattern.MatchString(summary) || phonePattern.MatchString(summary) || cardNumberPattern.MatchString(summary) {
+		reasons = append(reasons, "contains personal information (email, phone or card number)")
+	}
+
+	if match := spoilerPattern.FindString(summary); match != "" {
+		reasons = append(reasons, fmt.Sprintf("possible spoiler: %q", match))
+	}
+
+	return reasons
+}
+
+// Handler for GET /api/admin/summary-reviews
+func getSummaryReviews(c *gin.Context) {
+	slog.DebugContext(c.Request.Context(), "Inside getSummaryReviews func")
+
+	status := c.DefaultQuery("status", REVIEW_STATUS_PENDING)
+	slog.DebugContext(c.Request.Context(), "Query", "status", status)
+
+	reviews, err := GetSummaryReviews_DB(c.Request.Context(), status)
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, response(http.StatusOK, true, "Summary reviews fetched", reviews))
+}
+
+// Handler for POST /api/admin/summary-reviews/:reviewId/approve
+// Editors can send a corrected 'summary' form field, otherwise the generated text is used
+func approveSummaryReview(c *gin.Context) {
+	slog.DebugContext(c.Request.Context(), "Inside approveSummaryReview func")
+
+	review, err := GetSummaryReview_DB(c.Request.Context(), c.Param("reviewId"))
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+
+	summary := review.Summary
+	if edited := strings.TrimSpace(c.PostForm("summary")); edited != "" {
+		// editors are held to the same checks as the model
+		if reasons := validateSummary(edited); len(reasons) > 0 {
+			violations := make([]FieldError, len(reasons))
+			for i, reason := range reasons {
+				violations[i] = FieldError{Field: "summary", Message: reason}
+			}
+			respondError(c, validationError("edited summary failed the summary checks", violations...))
+			return
+		}
+		summary = edited
+	}
+
+	if err := ApproveSummaryReview_DB(c.Request.Context(), review, summary); err != nil {
+		respondError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, response(http.StatusOK, true, "Summary approved", nil))
+}
+
+// Handler for POST /api/admin/summary-reviews/:reviewId/reject
+// The next summary request for the movie generates a new one
+func rejectSummaryReview(c *gin.Context) {
+	slog.DebugContext(c.Request.Context(), "Inside rejectSummaryReview func")
+
+	review, err := GetSummaryReview_DB(c.Request.Context(), c.Param("reviewId"))
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+
+	if err := UpdateSummaryReviewStatus_DB(c.Request.Context(), review.ReviewId, REVIEW_STATUS_REJECTED); err != nil {
+		respondError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, response(http.StatusOK, true, "Summary rejected", nil))
+}
+
+// Put a flagged summary in quarantine in DB
+func AddSummaryReview_DB(ctx context.Context, movieId int, summary string, modelId string, reasons []string) error {
+	slog.DebugContext(ctx, "Inside AddSummaryReview_DB func")
+
+	ctx, cancel := dbContext(ctx)
+	defer cancel()
+
+	reasonsJson, err := json.Marshal(reasons)
+	if err != nil {
+		return fmt.Errorf("AddSummaryReview_DB error: %v", err)
+	}
+
+	_, err = db.ExecContext(ctx, "INSERT INTO summary_reviews (movieId, summary, modelId, reasons) VALUES (?,?,?,?)", movieId, summary, modelId, string(reasonsJson))
+	if err != nil {
+		return fmt.Errorf("AddSummaryReview_DB error: %v", err)
+	}
+
+	return nil
+}
+
+// Check if a movie has a quarantined summary waiting for review in DB
+func HasPendingSummaryReview_DB(ctx context.Context, movieId int) (bool, error) {
+	slog.DebugContext(ctx, "Inside HasPendingSummaryReview_DB func")
+
+	ctx, cancel := dbContext(ctx)
+	defer cancel()
+
+	var count int
+	if err := db.QueryRowContext(ctx, "SELECT COUNT(*) FROM summary_reviews WHERE movieId = ? AND status = ?", movieId, REVIEW_STATUS_PENDING).Scan(&count); err != nil {
+		return false, fmt.Errorf("HasPendingSummaryReview_DB error: %v", err)
+	}
+
+	return count > 0, nil
+}
+
+const summaryReviewColumns = "reviewId, movieId, summary, modelId, reasons, status, createdAt, reviewedAt"
+
+func scanSummaryReview(row rowScanner, review *SummaryReview) error {
+	var reasons string
+	if err := row.Scan(&review.ReviewId, &review.MovieId, &review.Summary, &review.ModelId, &reasons, &review.Status, &review.CreatedAt, &review.ReviewedAt); err != nil {
+		return err
+	}
+
+	return json.Unmarshal([]byte(reasons), &review.Reasons)
+}
+
+// Get the summary reviews with the given status, oldest first, from DB
+func GetSummaryReviews_DB(ctx context.Context, status string) ([]SummaryReview, error) {
+	slog.DebugContext(ctx, "Inside GetSummaryReviews_DB func")
+
+	ctx, cancel := dbContext(ctx)
+	defer cancel()
+
+	rows, err := db.QueryContext(ctx, "SELECT "+summaryReviewColumns+" FROM summary_reviews WHERE status = ? ORDER BY reviewId", status)
+	if err != nil {
+		return nil, fmt.Errorf("GetSummaryReviews_DB error: %v", err)
+	}
+
+	defer rows.Close()
+
+	reviews := []SummaryReview{}
+	for rows.Next() {
+		var review SummaryReview
+
+		if err := scanSummaryReview(rows, &review); err != nil {
+			return nil, fmt.Errorf("GetSummaryReviews_DB error: %v", err)
+		}
+
+		reviews = append(reviews, review)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("GetSummaryReviews_DB error: %v", err)
+	}
+
+	return reviews, nil
+}
+
+// Get a single summary review from DB
+func GetSummaryReview_DB(ctx context.Context, reviewId string) (SummaryReview, error) {
+	slog.DebugContext(ctx, "Inside GetSummaryReview_DB func")
+
+	ctx, cancel := dbContext(ctx)
+	defer cancel()
+
+	var review SummaryReview
+	row := db.QueryRowContext(ctx, "SELECT "+summaryReviewColumns+" FROM summary_reviews WHERE reviewId = ?", reviewId)
+
+	if err := scanSummaryReview(row, &review); err != nil {
+		if err == sql.ErrNoRows {
+			slog.DebugContext(ctx, "GetSummaryReview_DB error", "error", err)
+			return review, newError(ErrNotFound, "No summary review found with given reviewId")
+		}
+		return review, fmt.Errorf("GetSummaryReview_DB error: %v", err)
+	}
+
+	return review, nil
+}
+
+// Update the status of a pending summary review in DB. Returns ErrSummaryReviewed when
+// it was already approved or rejected, e.g. by a concurrent request.
+func UpdateSummaryReviewStatus_DB(ctx context.Context, reviewId int, status string) error {
+	slog.DebugContext(ctx, "Inside UpdateSummaryReviewStatus_DB func")
+
+	ctx, cancel := dbContext(ctx)
+	defer cancel()
+
+	result, err := db.ExecContext(ctx, "UPDATE summary_reviews SET status = ?, reviewedAt = CURRENT_TIMESTAMP WHERE reviewId = ? AND status = ?", status, reviewId, REVIEW_STATUS_PENDING)
+	if err != nil {
+		return fmt.Errorf("UpdateSummaryReviewStatus_DB error: %v", err)
+	}
+
+	return pendingReviewUpdated(result)
+}
+
+// Only one of concurrent reviews updates the pending row, the others get ErrSummaryReviewed
+func pendingReviewUpdated(result sql.Result) error {
+	updated, err := result.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("pendingReviewUpdated error: %v", err)
+	}
+	if updated == 0 {
+		return ErrSummaryReviewed
+	}
+
+	return nil
+}
+
+// Approve a pending quarantined summary and save it on the movie in DB
+func ApproveSummaryReview_DB(ctx context.Context, review SummaryReview, summary string) error {
+	slog.DebugContext(ctx, "Inside ApproveSummaryReview_DB func")
+
+	ctx, cancel := dbContext(ctx)
+	defer cancel()
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("ApproveSummaryReview_DB error: %v", err)
+	}
+	defer tx.Rollback()
+
+	result, err := tx.ExecContext(ctx, "UPDATE summary_reviews SET status = ?, summary = ?, reviewedAt = CURRENT_TIMESTAMP WHERE reviewId = ? AND status = ?", REVIEW_STATUS_APPROVED, summary, review.ReviewId, REVIEW_STATUS_PENDING)
+	if err != nil {
+		return fmt.Errorf("ApproveSummaryReview_DB error: %v", err)
+	}
+	if err := pendingReviewUpdated(result); err != nil {
+		return err
+	}
+
+	if _, err := tx.ExecContext(ctx, "UPDATE movie_details SET generatedSummary = ?, summaryModelId = ? WHERE movieId = ?", summary, review.ModelId, review.MovieId); err != nil {
+		return fmt.Errorf("ApproveSummaryReview_DB error: %v", err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("ApproveSummaryReview_DB error: %v", err)
+	}
+
+	return nil
+}
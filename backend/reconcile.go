@@ -0,0 +1,254 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Prefixes owned by the API, anything in them should be referenced from the DB
+var managedPrefixes = []string{s3Prefix + "/", UPLOAD_PREFIX + "/"}
+
+// OrphanObject is a stored object no movie or gallery image refers to
+type OrphanObject struct {
+	Key          string    `json:"key"`
+	Size         int64     `json:"size"`
+	LastModified time.Time `json:"lastModified"`
+	Deleted      bool      `json:"deleted"`
+}
+
+// DanglingReference is a key in the DB whose object is missing from the store
+type DanglingReference struct {
+	Key       string `json:"key"`
+	Reference string `json:"reference"`
+}
+
+type ReconcileReport struct {
+	StartedAt       time.Time           `json:"startedAt"`
+	GracePeriod     string              `json:"gracePeriod"`
+	ObjectsScanned  int                 `json:"objectsScanned"`
+	KeysReferenced  int                 `json:"keysReferenced"`
+	Orphans         []OrphanObject      `json:"orphans"`
+	OrphanBytes     int64               `json:"orphanBytes"`
+	DeletedCount    int                 `json:"deletedCount"`
+	Dangling        []DanglingReference `json:"dangling"`
+	DeleteErrors    []string            `json:"deleteErrors"`
+	DeleteRequested bool                `json:"deleteRequested"`
+}
+
+// Compare the objects in the managed prefixes with the keys referenced in DB.
+// With deleteOrphans, orphans older than the grace period are deleted; younger ones may
+// belong to an upload whose DB write hasn't happened yet.
+func reconcileStorage(ctx context.Context, deleteOrphans bool, grace time.Duration) (ReconcileReport, error) {
+	slog.DebugContext(ctx, "Inside reconcileStorage func")
+
+	report := ReconcileReport{
+		StartedAt:       time.Now(),
+		GracePeriod:     grace.String(),
+		Orphans:         []OrphanObject{},
+		Dangling:        []DanglingReference{},
+		DeleteErrors:    []string{},
+		DeleteRequested: deleteOrphans,
+	}
+
+	// list before reading the references, so an object written in between is either
+	// referenced already or younger than the grace period
+	objects := map[string]ObjectInfo{}
+	for _, prefix := range managedPrefixes {
+		listCtx, cancel := blobContext(ctx)
+		listed, err := Blobs.List(listCtx, prefix)
+		cancel()
+		if err != nil {
+			return report, fmt.Errorf("reconcileStorage error: %v", err)
+		}
+		for _, object := range listed {
+			objects[object.Key] = object
+		}
+	}
+
+	references, err := GetReferencedObjectKeys_DB(ctx)
+	if err != nil {
+		return report, err
+	}
+
+	report.ObjectsScanned = len(objects)
+	report.KeysReferenced = len(references)
+
+	for key, reference := range references {
+		if _, ok := objects[key]; !ok {
+			report.Dangling = append(report.Dangling, DanglingReference{Key: key, Reference: reference})
+		}
+	}
+
+	for key, object := range objects {
+		if _, ok := references[key]; ok {
+			continue
+		}
+
+		orphan := OrphanObject{Key: key, Size: object.Size, LastModified: object.LastModified}
+		report.OrphanBytes += object.Size
+
+		if deleteOrphans && time.Since(object.LastModified) > grace {
+			if err := deleteCoverImage(ctx, key); err != nil {
+				report.DeleteErrors = append(report.DeleteErrors, fmt.Sprintf("%v: %v", key, err))
+			} else {
+				orphan.Deleted = true
+				report.DeletedCount++
+			}
+		}
+
+		report.Orphans = append(report.Orphans, orphan)
+	}
+
+	sort.Slice(report.Orphans, func(i, j int) bool { return report.Orphans[i].Key < report.Orphans[j].Key })
+	sort.Slice(report.Dangling, func(i, j int) bool { return report.Dangling[i].Key < report.Dangling[j].Key })
+
+	return report, nil
+}
+
+// Run the reconciliation periodically when gc.interval (STORAGE_GC_INTERVAL) is set, e.g. "24h".
+// Orphans are only deleted with gc.delete (STORAGE_GC_DELETE), otherwise the job only reports.
+// Stops when ctx is canceled, a run in progress is canceled with it.
+func startStorageGC(ctx context.Context) {
+	interval := appConfig.GC.Interval
+	if interval <= 0 {
+		return
+	}
+
+	deleteOrphans := appConfig.GC.Delete
+	grace := appConfig.GC.Grace
+
+	slog.Info("Storage reconciliation scheduled", "interval", interval, "deleteOrphans", deleteOrphans, "grace", grace)
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+
+			runCtx, span := startSpan(ctx, "job.storage_reconcile")
+			report, err := reconcileStorage(runCtx, deleteOrphans, grace)
+			endSpan(span, err)
+			if err != nil {
+				slog.Error("Storage reconciliation failed", "error", err)
+				continue
+			}
+			logReconcileReport(report)
+		}
+	}()
+}
+
+func logReconcileReport(report ReconcileReport) {
+	slog.Info("Storage reconciliation",
+		"objects", report.ObjectsScanned, "referencedKeys", report.KeysReferenced, "orphans", len(report.Orphans), "orphanBytes", report.OrphanBytes,
+		"deleted", report.DeletedCount, "dangling", len(report.Dangling), "deleteErrors", len(report.DeleteErrors))
+
+	for _, dangling := range report.Dangling {
+		slog.Warn("Dangling reference", "key", dangling.Key, "reference", dangling.Reference)
+	}
+	for _, deleteErr := range report.DeleteErrors {
+		slog.Error("Orphan delete failed", "error", deleteErr)
+	}
+}
+
+// Handler for GET /api/admin/storage/reconcile, a dry run that only reports
+func getStorageReconcileReport(c *gin.Context) {
+	slog.DebugContext(c.Request.Context(), "Inside getStorageReconcileReport func")
+
+	report, err := reconcileStorage(c.Request.Context(), false, appConfig.GC.Grace)
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, response(http.StatusOK, true, "Storage reconciliation report", report))
+}
+
+// Get every object key referenced by movie covers and gallery images, with what refers to it, from DB
+func GetReferencedObjectKeys_DB(ctx context.Context) (map[string]string, error) {
+	slog.DebugContext(ctx, "Inside GetReferencedObjectKeys_DB func")
+
+	ctx, cancel := dbContext(ctx)
+	defer cancel()
+
+	references := map[string]string{}
+
+	addVariants := func(variantsJson string, reference string) error {
+		var variants map[string]CoverVariant
+		if err := json.Unmarshal([]byte(variantsJson), &variants); err != nil {
+			return err
+		}
+		for name, variant := range variants {
+			references[variant.Jpeg] = fmt.Sprintf("%v %v variant", reference, name)
+			references[variant.Webp] = fmt.Sprintf("%v %v variant", reference, name)
+		}
+		return nil
+	}
+
+	rows, err := db.QueryContext(ctx, "SELECT movieId, coverKey, coverVariants FROM movie_details WHERE coverKey IS NOT NULL AND coverKey != ''")
+	if err != nil {
+		return nil, fmt.Errorf("GetReferencedObjectKeys_DB error: %v", err)
+	}
+
+	for rows.Next() {
+		var movieId int
+		var coverKey string
+		var variants *string
+		if err := rows.Scan(&movieId, &coverKey, &variants); err != nil {
+			rows.Close()
+			return nil, fmt.Errorf("GetReferencedObjectKeys_DB error: %v", err)
+		}
+
+		reference := fmt.Sprintf("movie %d cover", movieId)
+		references[coverKey] = reference
+		if variants != nil {
+			if err := addVariants(*variants, reference); err != nil {
+				rows.Close()
+				return nil, fmt.Errorf("GetReferencedObjectKeys_DB error: %v", err)
+			}
+		}
+	}
+	rows.Close()
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("GetReferencedObjectKeys_DB error: %v", err)
+	}
+
+	rows, err = db.QueryContext(ctx, "SELECT imageId, movieId, imageKey, variants FROM movie_images")
+	if err != nil {
+		return nil, fmt.Errorf("GetReferencedObjectKeys_DB error: %v", err)
+	}
+
+	defer rows.Close()
+
+	for rows.Next() {
+		var imageId, movieId int
+		var imageKey, variants string
+		if err := rows.Scan(&imageId, &movieId, &imageKey, &variants); err != nil {
+			return nil, fmt.Errorf("GetReferencedObjectKeys_DB error: %v", err)
+		}
+
+		reference := fmt.Sprintf("movie %d image %d", movieId, imageId)
+		references[imageKey] = reference
+		if err := addVariants(variants, reference); err != nil {
+			return nil, fmt.Errorf("GetReferencedObjectKeys_DB error: %v", err)
+		}
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("GetReferencedObjectKeys_DB error: %v", err)
+	}
+
+	return references, nil
+}
@@ -0,0 +1,224 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"math/rand/v2"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/bedrockruntime/types"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	DEFAULT_MODEL_TIMEOUT = 30 * time.Second
+	RETRY_BASE_DELAY      = 500 * time.Millisecond
+	RETRY_MAX_DELAY       = 8 * time.Second
+	CIRCUIT_FAILURE_LIMIT = 3
+)
+
+var ErrModelsUnavailable = newError(ErrUnavailable, "no model is currently available to generate a response, please try again later")
+
+// modelConfig is one entry of the ordered fallback chain
+type modelConfig struct {
+	ModelId string
+	Timeout time.Duration
+}
+
+// The fallback chain from the llm.models setting (BEDROCK_MODELS), already validated at startup
+func loadModelChain() []modelConfig {
+	specs, err := appConfig.LLM.ModelChain(DEFAULT_MODEL_TIMEOUT)
+	if err != nil {
+		logFatal("Invalid BEDROCK_MODELS", "error", err)
+	}
+
+	models := make([]modelConfig, len(specs))
+	for i, spec := range specs {
+		models[i] = modelConfig{ModelId: spec.ModelId, Timeout: spec.Timeout}
+	}
+
+	return models
+}
+
+// Throttling and temporary unavailability are worth retrying on the same model
+func isRetryableModelError(err error) bool {
+	var throttling *types.ThrottlingException
+	var unavailable *types.ServiceUnavailableException
+	var notReady *types.ModelNotReadyException
+	var internal *types.InternalServerException
+
+	return errors.As(err, &throttling) || errors.As(err, &unavailable) || errors.As(err, &notReady) || errors.As(err, &internal)
+}
+
+// Full jitter exponential backoff: a random delay between 0 and base * 2^attempt
+func retryDelay(attempt int) time.Duration {
+	delay := RETRY_BASE_DELAY << attempt
+	if delay > RETRY_MAX_DELAY || delay <= 0 {
+		delay = RETRY_MAX_DELAY
+	}
+
+	return time.Duration(rand.Int64N(int64(delay)))
+}
+
+// Wait for the backoff delay unless the context is cancelled first
+func sleepContext(ctx context.Context, delay time.Duration) error {
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+// circuitBreaker skips a model for a cool-down window after repeated failures. Once the
+// cool-down has passed it is half-open: a single probe call goes through, its failure
+// opens the breaker again right away and only a success closes it.
+type circuitBreaker struct {
+	mu         sync.Mutex
+	failures   int
+	open       bool
+	openUntil  time.Time
+	probeUntil time.Time // a probe is in flight until then, a lost probe doesn't block forever
+	cooldown   time.Duration
+}
+
+// Allow reports whether the model can be called, letting one probe through per cool-down
+// once the breaker is half-open
+func (b *circuitBreaker) Allow() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if !b.open {
+		return true
+	}
+
+	now := time.Now()
+	if now.Before(b.openUntil) || now.Before(b.probeUntil) {
+		return false
+	}
+
+	b.probeUntil = now.Add(b.cooldown)
+	return true
+}
+
+// Available reports whether Allow could let a call through, without taking the probe
+func (b *circuitBreaker) Available() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	now := time.Now()
+	return !b.open || (!now.Before(b.openUntil) && !now.Before(b.probeUntil))
+}
+
+func (b *circuitBreaker) Success() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.failures = 0
+	b.open = false
+	b.openUntil = time.Time{}
+	b.probeUntil = time.Time{}
+}
+
+func (b *circuitBreaker) Failure() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	// a failed probe opens it again without waiting for more failures
+	b.failures++
+	if b.open || b.failures >= CIRCUIT_FAILURE_LIMIT {
+		b.open = true
+		b.openUntil = time.Now().Add(b.cooldown)
+		b.probeUntil = time.Time{}
+	}
+}
+
+// Map an error a model won't recover from by retrying to its kind: a rejected request
+// is the input's fault, anything else is an upstream failure. Typed errors are kept.
+func modelError(err error) error {
+	var appErr *AppError
+	if errors.As(err, &appErr) {
+		return err
+	}
+
+	var validation *types.ValidationException
+	if errors.As(err, &validation) {
+		return wrapError(ErrValidation, "the model rejected the request", err)
+	}
+
+	return wrapError(ErrUpstream, "model request failed", err)
+}
+
+// Run call against every model of the chain in order, retrying retryable errors with
+// backoff, until one succeeds. Errors that aren't retryable are returned right away, the
+// next model would reject the request as well. canFallback is checked before moving on
+// so a stream that already sent text to the client is not restarted on another model.
+func (g *bedrockGenerator) withFallback(ctx context.Context, call func(ctx context.Context, modelId string) (GenerationResult, error), canFallback func() bool) (GenerationResult, error) {
+	var lastErr error
+
+	for _, model := range g.models {
+		breaker := g.breakers[model.ModelId]
+		if !breaker.Allow() {
+			slog.WarnContext(ctx, "Skipping model, circuit is open", "modelId", model.ModelId)
+			continue
+		}
+
+		for attempt := 0; attempt <= g.maxRetries; attempt++ {
+			if attempt > 0 {
+				delay := retryDelay(attempt - 1)
+				slog.WarnContext(ctx, "Retrying model", "modelId", model.ModelId, "delay", delay, "attempt", attempt+1)
+				if err := sleepContext(ctx, delay); err != nil {
+					return GenerationResult{}, err
+				}
+			}
+
+			callCtx, span := startSpan(ctx, "llm.attempt", trace.WithAttributes(
+				attribute.String("llm.model_id", model.ModelId),
+				attribute.Int("llm.attempt", attempt+1),
+			))
+			callCtx, cancel := context.WithTimeout(callCtx, model.Timeout)
+			result, err := call(callCtx, model.ModelId)
+			cancel()
+			endSpan(span, err)
+
+			if err == nil {
+				breaker.Success()
+				result.ModelId = model.ModelId
+				return result, nil
+			}
+
+			slog.WarnContext(ctx, "Model failed", "modelId", model.ModelId, "error", err)
+			lastErr = err
+
+			// the caller went away, there is no point in trying further
+			if ctx.Err() != nil {
+				return result, ctx.Err()
+			}
+
+			// not a sign the model is unhealthy, so the breaker is left alone
+			if !isRetryableModelError(err) && !errors.Is(err, context.DeadlineExceeded) {
+				return result, modelError(err)
+			}
+
+			if !canFallback() {
+				breaker.Failure()
+				return result, wrapError(ErrUnavailable, "the model stopped responding, please try again later", err)
+			}
+		}
+
+		breaker.Failure()
+	}
+
+	// every model was throttled, timed out or had an open circuit
+	if lastErr != nil {
+		slog.ErrorContext(ctx, "All models failed", "error", lastErr)
+	}
+
+	return GenerationResult{}, ErrModelsUnavailable
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCircuitBreaker(t *testing.T) {
+	// steps: "allow" and "deny" check Allow, "fail" and "succeed" report a call, "wait"
+	// lets the cool-down pass
+	tests := []struct {
+		name  string
+		steps []string
+	}{
+		{"closed below the limit", []string{"fail", "fail", "allow", "allow"}},
+		{"opens at the limit", []string{"fail", "fail", "fail", "deny"}},
+		{"success resets the count", []string{"fail", "fail", "succeed", "fail", "fail", "allow"}},
+		{"one probe after the cool-down", []string{"fail", "fail", "fail", "wait", "allow", "deny"}},
+		{"failed probe opens again", []string{"fail", "fail", "fail", "wait", "allow", "fail", "deny"}},
+		{"failed probe probes again next cool-down", []string{"fail", "fail", "fail", "wait", "allow", "fail", "wait", "allow", "deny"}},
+		{"successful probe closes", []string{"fail", "fail", "fail", "wait", "allow", "succeed", "allow", "allow", "fail", "allow"}},
+		{"lost probe is replaced after a cool-down", []string{"fail", "fail", "fail", "wait", "allow", "deny", "wait", "allow"}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			breaker := &circuitBreaker{cooldown: time.Minute}
+
+			for i, step := range test.steps {
+				switch step {
+				case "allow", "deny":
+					available := breaker.Available()
+					if allowed := breaker.Allow(); allowed != (step == "allow") || available != allowed {
+						t.Fatalf("step %d: expected %v, Allow returned %v and Available %v", i, step, allowed, available)
+					}
+				case "fail":
+					breaker.Failure()
+				case "succeed":
+					breaker.Success()
+				case "wait":
+					breaker.mu.Lock()
+					breaker.openUntil = breaker.openUntil.Add(-breaker.cooldown)
+					breaker.probeUntil = breaker.probeUntil.Add(-breaker.cooldown)
+					breaker.mu.Unlock()
+				}
+			}
+		})
+	}
+}
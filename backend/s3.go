@@ -2,69 +2,279 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
-	"log"
-	"mime/multipart"
+	"io"
+	"log/slog"
 	"time"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
 )
 
-const s3Prefix = "images"
+// s3BlobStore implements BlobStore on top of an S3 bucket
+type s3BlobStore struct {
+	client *s3.Client
+	bucket string
+	region string
+}
 
-func PutObject_S3(fileHeader *multipart.FileHeader, objectKey string) (string, error) {
-	log.Print("Inside PutObject_S3 func")
-	file, err := fileHeader.Open()
+func (s *s3BlobStore) Put(ctx context.Context, key string, body io.Reader, size int64, contentType string) error {
+	slog.DebugContext(ctx, "Inside s3BlobStore.Put func")
 
-	defer file.Close()
+	_, err := s.client.PutObject(ctx, &s3.PutObjectInput{
+		Bucket:        aws.String(s.bucket),
+		Key:           aws.String(key),
+		Body:          body,
+		ContentLength: aws.Int64(size),
+		ContentType:   aws.String(contentType),
+	})
 
+	// S3 is read-after-write consistent, the object can be read as soon as PutObject returns
 	if err != nil {
-		log.Printf("Error opening file to upload: %v", err)
-		return "", err
+		slog.ErrorContext(ctx, "Error uploading file", "key", key, "error", err)
+		return s3Error(err)
 	}
 
-	key := fmt.Sprintf("%v/%v", s3Prefix, objectKey)
+	return nil
+}
+
+func (s *s3BlobStore) Get(ctx context.Context, key string) (io.ReadCloser, ObjectInfo, error) {
+	slog.DebugContext(ctx, "Inside s3BlobStore.Get func")
 
-	_, err = S3Client.PutObject(context.TODO(), &s3.PutObjectInput{
-		Bucket:      aws.String(BUCKET_NAME),
-		Key:         aws.String(key),
-		Body:        file,
-		ContentType: aws.String(fileHeader.Header.Get("Content-Type")),
+	output, err := s.client.GetObject(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(key),
 	})
 
 	if err != nil {
-		log.Printf("Error uploading file: %v", err)
-		return "", err
+		return nil, ObjectInfo{}, s3Error(err)
 	}
 
-	if err := s3.NewObjectExistsWaiter(S3Client).Wait(context.TODO(), &s3.HeadObjectInput{
-		Bucket: aws.String(BUCKET_NAME),
-		Key:    aws.String(key),
-	}, time.Minute); err != nil {
-		log.Printf("Error waiting file: %v", err)
-		return "", err
+	info := ObjectInfo{
+		Key:          key,
+		Size:         aws.ToInt64(output.ContentLength),
+		ContentType:  aws.ToString(output.ContentType),
+		ETag:         aws.ToString(output.ETag),
+		LastModified: aws.ToTime(output.LastModified),
 	}
 
-	objectUrl := fmt.Sprintf("https://%s.s3.%s.amazonaws.com/%s", BUCKET_NAME, AWS_REGION, key)
+	return output.Body, info, nil
+}
+
+func (s *s3BlobStore) Open(ctx context.Context, key string) (io.ReadSeekCloser, ObjectInfo, error) {
+	slog.DebugContext(ctx, "Inside s3BlobStore.Open func")
+
+	info, err := s.Head(ctx, key)
+	if err != nil {
+		return nil, ObjectInfo{}, err
+	}
 
-	return objectUrl, nil
+	return &s3RangeReader{ctx: ctx, store: s, key: key, size: info.Size, etag: info.ETag}, info, nil
 }
 
-func DeleteObject_S3(objectKey string) error {
-	log.Print("Inside DeleteObject_S3 func")
+// s3RangeReader reads an object from the current offset with ranged GetObject calls,
+// a seek drops the open body so the next read starts a new range
+type s3RangeReader struct {
+	ctx    context.Context
+	store  *s3BlobStore
+	key    string
+	size   int64
+	etag   string
+	offset int64
+	body   io.ReadCloser
+}
 
-	key := fmt.Sprintf("%v/%v", s3Prefix, objectKey)
-	log.Printf("key: %v", key)
+func (r *s3RangeReader) Read(p []byte) (int, error) {
+	if r.offset >= r.size {
+		return 0, io.EOF
+	}
 
-	_, err := S3Client.DeleteObject(context.TODO(), &s3.DeleteObjectInput{
-		Bucket: aws.String(BUCKET_NAME),
+	if r.body == nil {
+		output, err := r.store.client.GetObject(r.ctx, &s3.GetObjectInput{
+			Bucket: aws.String(r.store.bucket),
+			Key:    aws.String(r.key),
+			Range:  aws.String(fmt.Sprintf("bytes=%d-", r.offset)),
+			// fail instead of mixing two versions of the object
+			IfMatch: aws.String(r.etag),
+		})
+		if err != nil {
+			return 0, s3Error(err)
+		}
+		r.body = output.Body
+	}
+
+	n, err := r.body.Read(p)
+	r.offset += int64(n)
+	return n, err
+}
+
+func (r *s3RangeReader) Seek(offset int64, whence int) (int64, error) {
+	var position int64
+	switch whence {
+	case io.SeekStart:
+		position = offset
+	case io.SeekCurrent:
+		position = r.offset + offset
+	case io.SeekEnd:
+		position = r.size + offset
+	}
+
+	if position < 0 {
+		return 0, fmt.Errorf("s3RangeReader: negative position")
+	}
+
+	if position != r.offset {
+		r.Close()
+		r.offset = position
+	}
+	return position, nil
+}
+
+func (r *s3RangeReader) Close() error {
+	if r.body == nil {
+		return nil
+	}
+
+	err := r.body.Close()
+	r.body = nil
+	return err
+}
+
+func (s *s3BlobStore) Delete(ctx context.Context, key string) error {
+	slog.DebugContext(ctx, "Inside s3BlobStore.Delete func")
+
+	_, err := s.client.DeleteObject(ctx, &s3.DeleteObjectInput{
+		Bucket: aws.String(s.bucket),
 		Key:    aws.String(key),
 	})
 
 	if err != nil {
-		log.Print(err)
-		return err
+		slog.ErrorContext(ctx, "Error deleting object", "key", key, "error", err)
+		return s3Error(err)
 	}
 	return nil
 }
+
+// HeadBucket fails when the bucket is gone or the credentials expired or lost access
+func (s *s3BlobStore) Ping(ctx context.Context) error {
+	_, err := s.client.HeadBucket(ctx, &s3.HeadBucketInput{Bucket: aws.String(s.bucket)})
+	return err
+}
+
+func (s *s3BlobStore) Head(ctx context.Context, key string) (ObjectInfo, error) {
+	slog.DebugContext(ctx, "Inside s3BlobStore.Head func")
+
+	output, err := s.client.HeadObject(ctx, &s3.HeadObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(key),
+	})
+
+	if err != nil {
+		return ObjectInfo{}, s3Error(err)
+	}
+
+	return ObjectInfo{
+		Key:          key,
+		Size:         aws.ToInt64(output.ContentLength),
+		ContentType:  aws.ToString(output.ContentType),
+		ETag:         aws.ToString(output.ETag),
+		LastModified: aws.ToTime(output.LastModified),
+	}, nil
+}
+
+func (s *s3BlobStore) List(ctx context.Context, prefix string) ([]ObjectInfo, error) {
+	slog.DebugContext(ctx, "Inside s3BlobStore.List func")
+
+	var objects []ObjectInfo
+
+	paginator := s3.NewListObjectsV2Paginator(s.client, &s3.ListObjectsV2Input{
+		Bucket: aws.String(s.bucket),
+		Prefix: aws.String(prefix),
+	})
+
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			slog.ErrorContext(ctx, "Error listing objects", "error", err)
+			return nil, s3Error(err)
+		}
+
+		for _, object := range page.Contents {
+			objects = append(objects, ObjectInfo{
+				Key:          aws.ToString(object.Key),
+				Size:         aws.ToInt64(object.Size),
+				ETag:         aws.ToString(object.ETag),
+				LastModified: aws.ToTime(object.LastModified),
+			})
+		}
+	}
+
+	return objects, nil
+}
+
+// Presigned PutObject url, Content-Type and Content-Length are part of the signature
+// so the client can only upload the declared type and size
+func (s *s3BlobStore) PresignPut(ctx context.Context, key string, contentType string, size int64, expires time.Duration) (PresignedUpload, error) {
+	slog.DebugContext(ctx, "Inside s3BlobStore.PresignPut func")
+
+	request, err := s3.NewPresignClient(s.client).PresignPutObject(ctx, &s3.PutObjectInput{
+		Bucket:        aws.String(s.bucket),
+		Key:           aws.String(key),
+		ContentType:   aws.String(contentType),
+		ContentLength: aws.Int64(size),
+	}, s3.WithPresignExpires(expires))
+
+	if err != nil {
+		slog.ErrorContext(ctx, "Error presigning upload", "key", key, "error", err)
+		return PresignedUpload{}, err
+	}
+
+	headers := map[string]string{}
+	for name, values := range request.SignedHeader {
+		// the client sets Host itself
+		if len(values) > 0 && name != "Host" {
+			headers[name] = values[0]
+		}
+	}
+
+	return PresignedUpload{
+		Url:       request.URL,
+		Method:    request.Method,
+		Headers:   headers,
+		ExpiresAt: time.Now().Add(expires),
+	}, nil
+}
+
+func (s *s3BlobStore) PresignGet(ctx context.Context, key string, expires time.Duration) (string, error) {
+	slog.DebugContext(ctx, "Inside s3BlobStore.PresignGet func")
+
+	request, err := s3.NewPresignClient(s.client).PresignGetObject(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(key),
+	}, s3.WithPresignExpires(expires))
+
+	if err != nil {
+		slog.ErrorContext(ctx, "Error presigning download", "key", key, "error", err)
+		return "", err
+	}
+
+	return request.URL, nil
+}
+
+func (s *s3BlobStore) PublicURL(key string) string {
+	return fmt.Sprintf("https://%s.s3.%s.amazonaws.com/%s", s.bucket, s.region, key)
+}
+
+// Map the S3 not found errors to ErrObjectNotFound and anything else to ErrUpstream
+func s3Error(err error) error {
+	var noSuchKey *types.NoSuchKey
+	var notFound *types.NotFound
+	if errors.As(err, &noSuchKey) || errors.As(err, &notFound) {
+		return ErrObjectNotFound
+	}
+
+	slog.Error("S3 error", "error", err)
+	return wrapError(ErrUpstream, "storage request failed", err)
+}
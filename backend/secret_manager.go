@@ -2,33 +2,39 @@ package main
 
 import (
 	"context"
-	"log"
-
-	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/service/secretsmanager"
+	"github.com/aws/aws-sdk-go-v2/service/secretsmanager/types"
 )
 
-func GetSecretByKey(secretId string, secretKey string) (string, error) {
+// awsSecrets reads secrets from AWS Secrets Manager, the name is the secret id or ARN.
+// Always the current version is fetched, so a rotated secret is picked up on the next fetch.
+type awsSecrets struct {
+	client *secretsmanager.Client
+}
+
+func (s awsSecrets) GetSecret(ctx context.Context, name string) (string, error) {
+	slog.DebugContext(ctx, "Inside awsSecrets.GetSecret func")
 
-	output, err := SecretManagerClient.GetSecretValue(context.TODO(), &secretsmanager.GetSecretValueInput{
-		SecretId: aws.String(secretId),
+	output, err := s.client.GetSecretValue(ctx, &secretsmanager.GetSecretValueInput{
+		SecretId: aws.String(name),
 	})
 
-	if err != nil {
-		log.Printf("Error getting secrets: %v", err)
-		return "", err
+	var notFound *types.ResourceNotFoundException
+	if errors.As(err, &notFound) {
+		return "", fmt.Errorf("%w: %v", ErrSecretNotFound, name)
 	}
-
-	var secretString map[string]string
-
-	err = json.Unmarshal([]byte(*output.SecretString), &secretString)
 	if err != nil {
-		return "", err
+		return "", fmt.Errorf("awsSecrets.GetSecret error: %v", err)
 	}
 
-	log.Print(secretString[secretKey])
+	if output.SecretString == nil {
+		return "", fmt.Errorf("awsSecrets.GetSecret error: secret %v has no string value", name)
+	}
 
-	return secretString[secretKey], nil
+	return *output.SecretString, nil
 }
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/AJ-Walker/movies-rest-api/config"
+)
+
+// a rejected secret is fetched again at most this often, so a wrong one doesn't hammer the provider
+const SECRET_MIN_REFRESH time.Duration = 10 * time.Second
+
+var ErrSecretNotFound = errors.New("secret not found")
+
+// SecretsProvider is where credentials such as the DB password come from. Secret values
+// must never be logged or put into errors.
+type SecretsProvider interface {
+	// Current value of a secret. The name is an env variable, a file name or a Secrets
+	// Manager id, depending on the provider.
+	GetSecret(ctx context.Context, name string) (string, error)
+}
+
+var Secrets *secretCache
+
+// Pick the secrets provider based on the secrets.provider setting (SECRETS_PROVIDER): "env"
+// (default), "file" for Docker or Kubernetes secrets, or "aws" for Secrets Manager
+func InitSecrets() {
+	var provider SecretsProvider
+	switch appConfig.Secrets.Provider {
+	case config.SECRETS_FILE:
+		provider = fileSecrets{dir: appConfig.Secrets.Dir}
+	case config.SECRETS_AWS:
+		provider = awsSecrets{client: SecretManagerClient}
+	default:
+		provider = envSecrets{}
+	}
+
+	slog.Info("Using secrets provider", "provider", appConfig.Secrets.Provider, "cacheTtl", appConfig.Secrets.CacheTTL)
+	Secrets = newSecretCache(provider, appConfig.Secrets.CacheTTL)
+}
+
+// envSecrets reads secrets from environment variables, for local development
+type envSecrets struct{}
+
+func (envSecrets) GetSecret(ctx context.Context, name string) (string, error) {
+	value, ok := os.LookupEnv(name)
+	if !ok {
+		return "", fmt.Errorf("%w: env %v is not set", ErrSecretNotFound, name)
+	}
+	return value, nil
+}
+
+// fileSecrets reads secrets from one file per secret in a directory, as mounted by Docker
+// and Kubernetes. Files are read again on every fetch, so rotated files are picked up.
+type fileSecrets struct {
+	dir string
+}
+
+func (s fileSecrets) GetSecret(ctx context.Context, name string) (string, error) {
+	// names are plain file names, never paths out of the directory
+	if name == "" || filepath.Base(name) != name || name == ".." {
+		return "", fmt.Errorf("fileSecrets error: invalid secret name %q", name)
+	}
+
+	data, err := os.ReadFile(filepath.Join(s.dir, name))
+	if errors.Is(err, fs.ErrNotExist) {
+		return "", fmt.Errorf("%w: no file %v in %v", ErrSecretNotFound, name, s.dir)
+	}
+	if err != nil {
+		return "", fmt.Errorf("fileSecrets error: %v", err)
+	}
+
+	// secret files are usually written with a trailing newline
+	return strings.TrimRight(string(data), "\r\n"), nil
+}
+
+// secretCache keeps fetched secrets for a TTL in front of a provider
+type secretCache struct {
+	provider SecretsProvider
+	ttl      time.Duration
+	mu       sync.Mutex
+	entries  map[string]cachedSecret
+}
+
+type cachedSecret struct {
+	value     string
+	fetchedAt time.Time
+}
+
+func newSecretCache(provider SecretsProvider, ttl time.Duration) *secretCache {
+	return &secretCache{provider: provider, ttl: ttl, entries: map[string]cachedSecret{}}
+}
+
+// Get a secret, fetching it from the provider when it isn't cached or has expired. If the
+// provider fails, an expired value is still returned rather than failing the caller.
+func (c *secretCache) Get(ctx context.Context, name string) (string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	entry, ok := c.entries[name]
+	if ok && time.Since(entry.fetchedAt) < c.ttl {
+		return entry.value, nil
+	}
+
+	value, err := c.provider.GetSecret(ctx, name)
+	if err != nil {
+		if ok {
+			slog.WarnContext(ctx, "Cannot refresh secret, using the cached value", "secret", name, "error", err)
+			return entry.value, nil
+		}
+		return "", err
+	}
+
+	c.entries[name] = cachedSecret{value: value, fetchedAt: time.Now()}
+	return value, nil
+}
+
+// Get a field of a JSON secret, or the whole value when key is empty
+func (c *secretCache) GetField(ctx context.Context, name string, key string) (string, error) {
+	value, err := c.Get(ctx, name)
+	if err != nil || key == "" {
+		return value, err
+	}
+
+	// the unmarshal error could quote part of the secret, so it isn't passed on
+	var fields map[string]any
+	if err := json.Unmarshal([]byte(value), &fields); err != nil {
+		return "", fmt.Errorf("secret %v is not a JSON object", name)
+	}
+
+	field, ok := fields[key].(string)
+	if !ok {
+		return "", fmt.Errorf("%w: secret %v has no string field %v", ErrSecretNotFound, name, key)
+	}
+
+	return field, nil
+}
+
+// Drop a secret so the next Get fetches it again, e.g. after it was rejected because it was
+// rotated. Returns false when it was fetched too recently to be worth fetching again.
+func (c *secretCache) Invalidate(name string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	entry, ok := c.entries[name]
+	if ok && time.Since(entry.fetchedAt) < SECRET_MIN_REFRESH {
+		return false
+	}
+
+	delete(c.entries, name)
+	return true
+}
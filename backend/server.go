@@ -0,0 +1,157 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// How long canceled background jobs get to return before the DB is closed under them
+const JOB_CANCEL_GRACE = 5 * time.Second
+
+// Work started by a request that has to outlive it, e.g. alt text generation after an upload
+var backgroundJobs = newJobGroup()
+
+// jobGroup tracks background jobs so shutdown can wait for them, and cancel them once
+// it stops waiting
+type jobGroup struct {
+	mu      sync.Mutex
+	running sync.WaitGroup
+	stopped bool
+
+	// parent of every job context, canceled when shutdown gives up waiting
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+func newJobGroup() *jobGroup {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &jobGroup{ctx: ctx, cancel: cancel}
+}
+
+// Run fn in the background with a context that keeps the request's values but isn't
+// canceled when the client goes away, only when shutdown gives up waiting for it. Jobs
+// started once shutdown has begun are dropped. The job gets its own span in the trace
+// of the request, named "job.<name>".
+func runInBackground(ctx context.Context, name string, fn func(ctx context.Context)) {
+	backgroundJobs.mu.Lock()
+	defer backgroundJobs.mu.Unlock()
+
+	if backgroundJobs.stopped {
+		slog.WarnContext(ctx, "Shutting down, background job dropped", "job", name)
+		return
+	}
+
+	backgroundJobs.running.Add(1)
+	metrics.backgroundJobs.Inc()
+	go func() {
+		defer backgroundJobs.running.Done()
+		defer metrics.backgroundJobs.Dec()
+
+		ctx, cancel := context.WithCancel(context.WithoutCancel(ctx))
+		defer cancel()
+		stop := context.AfterFunc(backgroundJobs.ctx, cancel)
+		defer stop()
+
+		ctx, span := startSpan(ctx, "job."+name)
+		defer span.End()
+
+		fn(ctx)
+	}()
+}
+
+// Stop accepting jobs and wait for the running ones until ctx is done. Jobs still running
+// then are canceled and get JOB_CANCEL_GRACE to return. Reports whether all finished.
+func (g *jobGroup) Stop(ctx context.Context) bool {
+	g.mu.Lock()
+	g.stopped = true
+	g.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		g.running.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return true
+	case <-ctx.Done():
+	}
+
+	slog.Warn("Background jobs did not finish in time, canceling them")
+	g.cancel()
+
+	select {
+	case <-done:
+		return true
+	case <-time.After(JOB_CANCEL_GRACE):
+		return false
+	}
+}
+
+// Serve the API until ctx is canceled. Then /readyz fails for server.shutdownDelay while
+// requests are still served, and the server stops accepting connections and waits up to
+// server.shutdownTimeout for in-flight requests and background jobs to finish.
+func runServer(ctx context.Context, handler http.Handler) {
+	server := &http.Server{
+		Addr:              appConfig.Server.ListenAddr,
+		Handler:           handler,
+		ReadHeaderTimeout: appConfig.Server.ReadHeaderTimeout,
+		IdleTimeout:       appConfig.Server.IdleTimeout,
+	}
+
+	serveErr := make(chan error, 1)
+	go func() {
+		slog.Info("Listening", "addr", server.Addr)
+		serveErr <- server.ListenAndServe()
+	}()
+
+	select {
+	case err := <-serveErr:
+		if !errors.Is(err, http.ErrServerClosed) {
+			logFatal("Server error", "error", err)
+		}
+	case <-ctx.Done():
+	}
+
+	// load balancers stop sending new requests once they have seen /readyz fail
+	Readiness.shuttingDown.Store(true)
+	if delay := appConfig.Server.ShutdownDelay; delay > 0 {
+		slog.Info("Shutting down, waiting for load balancers to stop sending requests", "delay", delay)
+		time.Sleep(delay)
+	}
+
+	slog.Info("Shutting down, waiting for in-flight requests", "timeout", appConfig.Server.ShutdownTimeout)
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), appConfig.Server.ShutdownTimeout)
+	defer cancel()
+
+	drained := true
+	if err := server.Shutdown(shutdownCtx); err != nil {
+		slog.Warn("Shutdown did not finish in time", "error", err)
+		drained = false
+	}
+
+	if !backgroundJobs.Stop(shutdownCtx) {
+		slog.Error("Background jobs still running after being canceled")
+		drained = false
+	}
+
+	// requests or jobs still running would fail with "sql: database is closed", the
+	// connections go away with the process instead
+	if drained {
+		if err := db.Close(); err != nil {
+			slog.Error("Error closing DB", "error", err)
+		}
+	} else {
+		slog.Warn("Not closing the DB, requests or background jobs are still running")
+	}
+
+	// spans of the last requests, within what is left of the shutdown timeout
+	shutdownTracing(shutdownCtx)
+
+	slog.Info("Server stopped")
+}
@@ -0,0 +1,395 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	TAG_KIND_GENRE    string = "genre"
+	TAG_KIND_KEYWORD  string = "keyword"
+	TAG_KIND_ADVISORY string = "advisory"
+
+	TAG_STATUS_PENDING  string = "pending"
+	TAG_STATUS_ACCEPTED string = "accepted"
+	TAG_STATUS_REJECTED string = "rejected"
+
+	MAX_SUGGESTED_KEYWORDS int = 10
+)
+
+var ErrSuggestionReviewed = newError(ErrConflict, "suggestion was already accepted or rejected")
+
+type TagSuggestion struct {
+	SuggestionId int       `json:"suggestionId"`
+	MovieId      int       `json:"movieId"`
+	Kind         string    `json:"kind"`
+	Value        string    `json:"value"`
+	Status       string    `json:"status"`
+	CreatedAt    time.Time `json:"createdAt"`
+}
+
+// Shape of the JSON the model is asked to return
+type tagProposal struct {
+	Genres          []string `json:"genres"`
+	Keywords        []string `json:"keywords"`
+	ContentAdvisory string   `json:"contentAdvisory"`
+}
+
+// Handler for POST /api/movies/:movieId/tags/suggest
+func suggestMovieTags(c *gin.Context) {
+	slog.DebugContext(c.Request.Context(), "Inside suggestMovieTags func")
+
+	movieId := c.Param("movieId")
+	if movieId == "" {
+		respondError(c, invalidField("movieId", "cannot be empty"))
+		return
+	}
+
+	movie, err := GetMovieById_DB(c.Request.Context(), movieId)
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+
+	suggestions, err := SuggestMovieTags(c.Request.Context(), movie, llmUser(c))
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, response(http.StatusOK, true, "Tag suggestions generated", suggestions))
+}
+
+// Handler for GET /api/movies/:movieId/tags/suggestions
+func getTagSuggestions(c *gin.Context) {
+	slog.DebugContext(c.Request.Context(), "Inside getTagSuggestions func")
+
+	slog.DebugContext(c.Request.Context(), "Query", "status", c.Query("status"))
+
+	suggestions, err := GetTagSuggestions_DB(c.Request.Context(), c.Param("movieId"), c.Query("status"))
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, response(http.StatusOK, true, "Tag suggestions fetched", suggestions))
+}
+
+// Handler for POST /api/movies/:movieId/tags/suggestions/:suggestionId/accept
+func acceptTagSuggestion(c *gin.Context) {
+	slog.DebugContext(c.Request.Context(), "Inside acceptTagSuggestion func")
+
+	suggestion, err := GetTagSuggestion_DB(c.Request.Context(), c.Param("movieId"), c.Param("suggestionId"))
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+
+	if err := AcceptTagSuggestion_DB(c.Request.Context(), suggestion); err != nil {
+		respondError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, response(http.StatusOK, true, "Tag suggestion accepted", nil))
+}
+
+// Handler for POST /api/movies/:movieId/tags/suggestions/:suggestionId/reject
+func rejectTagSuggestion(c *gin.Context) {
+	slog.DebugContext(c.Request.Context(), "Inside rejectTagSuggestion func")
+
+	suggestion, err := GetTagSuggestion_DB(c.Request.Context(), c.Param("movieId"), c.Param("suggestionId"))
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+
+	if err := UpdateTagSuggestionStatus_DB(c.Request.Context(), suggestion.SuggestionId, TAG_STATUS_REJECTED); err != nil {
+		respondError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, response(http.StatusOK, true, "Tag suggestion rejected", nil))
+}
+
+// Ask the model for genres, keywords and a content advisory rating and store them as
+// pending suggestions, replacing any earlier suggestions that were not reviewed yet
+func SuggestMovieTags(ctx context.Context, movie Movie, userId string) ([]TagSuggestion, error) {
+	slog.DebugContext(ctx, "Inside SuggestMovieTags func")
+
+	prompt := fmt.Sprintf(`Suggest tags for the movie described below.
+Respond with only a JSON object of the form {"genres": [], "keywords": [], "contentAdvisory": ""} where:
+- genres are 1 to 3 values picked only from this list: %v
+- keywords are up to %d short lowercase keywords describing themes, setting or style
+- contentAdvisory is one of: %v
+
+%v`,
+		strings.Join(GENRE_VOCABULARY, ", "), MAX_SUGGESTED_KEYWORDS, strings.Join(CONTENT_ADVISORY_RATINGS, ", "), movieDataBlock(movie))
+
+	result, err := Generator.Generate(ctx, GenerationRequest{
+		System:    "You are a film librarian that classifies movies. Only respond with JSON. " + DATA_BLOCK_INSTRUCTION,
+		Messages:  []ChatMessage{{Role: ROLE_USER, Content: prompt}},
+		MaxTokens: 300,
+		Operation: LLM_OP_TAGGING,
+		UserId:    userId,
+	})
+	if err != nil {
+		slog.ErrorContext(ctx, "Error suggesting tags", "movieId", movie.MovieId, "error", err)
+		return nil, err
+	}
+
+	proposal, err := parseTagProposal(result.Text)
+	if err != nil {
+		slog.WarnContext(ctx, "Invalid tag proposal", "text", result.Text, "error", err)
+		return nil, newError(ErrUpstream, "model did not return valid tag suggestions")
+	}
+
+	var suggestions []TagSuggestion
+	for _, genre := range proposal.Genres {
+		suggestions = append(suggestions, TagSuggestion{MovieId: movie.MovieId, Kind: TAG_KIND_GENRE, Value: genre})
+	}
+	for _, keyword := range proposal.Keywords {
+		suggestions = append(suggestions, TagSuggestion{MovieId: movie.MovieId, Kind: TAG_KIND_KEYWORD, Value: keyword})
+	}
+	if proposal.ContentAdvisory != "" {
+		suggestions = append(suggestions, TagSuggestion{MovieId: movie.MovieId, Kind: TAG_KIND_ADVISORY, Value: proposal.ContentAdvisory})
+	}
+
+	if err := ReplacePendingTagSuggestions_DB(ctx, movie.MovieId, suggestions); err != nil {
+		return nil, err
+	}
+
+	return GetTagSuggestions_DB(ctx, fmt.Sprint(movie.MovieId), TAG_STATUS_PENDING)
+}
+
+// Parse the model output and drop anything outside the controlled vocabulary
+func parseTagProposal(text string) (tagProposal, error) {
+	var proposal tagProposal
+
+	// models sometimes wrap the JSON in prose or code fences
+	start, end := strings.Index(text, "{"), strings.LastIndex(text, "}")
+	if start == -1 || end < start {
+		return proposal, fmt.Errorf("no JSON object found")
+	}
+
+	if err := json.Unmarshal([]byte(text[start:end+1]), &proposal); err != nil {
+		return proposal, err
+	}
+
+	var genres []string
+	for _, genre := range proposal.Genres {
+		if canonical, ok := canonicalGenre(GENRE_VOCABULARY, genre); ok && !slices.Contains(genres, canonical) {
+			genres = append(genres, canonical)
+		}
+	}
+
+	var keywords []string
+	for _, keyword := range proposal.Keywords {
+		keyword = strings.ToLower(strings.TrimSpace(keyword))
+		if keyword != "" && len(keyword) <= 50 && !slices.Contains(keywords, keyword) && len(keywords) < MAX_SUGGESTED_KEYWORDS {
+			keywords = append(keywords, keyword)
+		}
+	}
+
+	advisory := strings.ToUpper(strings.TrimSpace(proposal.ContentAdvisory))
+	if !slices.Contains(CONTENT_ADVISORY_RATINGS, advisory) {
+		advisory = ""
+	}
+
+	return tagProposal{Genres: genres, Keywords: keywords, ContentAdvisory: advisory}, nil
+}
+
+// Add a genre to the comma separated genre list of a movie if it's not already there
+func addGenre(genreList string, genre string) string {
+	var genres []string
+	for _, g := range strings.Split(genreList, ",") {
+		if g = strings.TrimSpace(g); g != "" {
+			genres = append(genres, g)
+		}
+	}
+
+	if slices.ContainsFunc(genres, func(g string) bool { return strings.EqualFold(g, genre) }) {
+		return genreList
+	}
+
+	return strings.Join(append(genres, genre), ", ")
+}
+
+// Replace the pending tag suggestions of a movie in DB
+func ReplacePendingTagSuggestions_DB(ctx context.Context, movieId int, suggestions []TagSuggestion) error {
+	slog.DebugContext(ctx, "Inside ReplacePendingTagSuggestions_DB func")
+
+	ctx, cancel := dbContext(ctx)
+	defer cancel()
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("ReplacePendingTagSuggestions_DB error: %v", err)
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx, "DELETE FROM movie_tag_suggestions WHERE movieId = ? AND status = ?", movieId, TAG_STATUS_PENDING); err != nil {
+		return fmt.Errorf("ReplacePendingTagSuggestions_DB error: %v", err)
+	}
+
+	for _, suggestion := range suggestions {
+		if _, err := tx.ExecContext(ctx, "INSERT INTO movie_tag_suggestions (movieId, kind, value, status) VALUES (?,?,?,?)", movieId, suggestion.Kind, suggestion.Value, TAG_STATUS_PENDING); err != nil {
+			return fmt.Errorf("ReplacePendingTagSuggestions_DB error: %v", err)
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("ReplacePendingTagSuggestions_DB error: %v", err)
+	}
+
+	return nil
+}
+
+// Get the tag suggestions of a movie, optionally filtered by status, from DB
+func GetTagSuggestions_DB(ctx context.Context, movieId string, status string) ([]TagSuggestion, error) {
+	slog.DebugContext(ctx, "Inside GetTagSuggestions_DB func")
+
+	ctx, cancel := dbContext(ctx)
+	defer cancel()
+
+	query := "SELECT suggestionId, movieId, kind, value, status, createdAt FROM movie_tag_suggestions WHERE movieId = ?"
+	args := []any{movieId}
+	if status != "" {
+		query += " AND status = ?"
+		args = append(args, status)
+	}
+
+	rows, err := db.QueryContext(ctx, query+" ORDER BY suggestionId", args...)
+	if err != nil {
+		return nil, fmt.Errorf("GetTagSuggestions_DB error: %v", err)
+	}
+
+	defer rows.Close()
+
+	suggestions := []TagSuggestion{}
+	for rows.Next() {
+		var suggestion TagSuggestion
+
+		if err := rows.Scan(&suggestion.SuggestionId, &suggestion.MovieId, &suggestion.Kind, &suggestion.Value, &suggestion.Status, &suggestion.CreatedAt); err != nil {
+			return nil, fmt.Errorf("GetTagSuggestions_DB error: %v", err)
+		}
+
+		suggestions = append(suggestions, suggestion)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("GetTagSuggestions_DB error: %v", err)
+	}
+
+	return suggestions, nil
+}
+
+// Get a single tag suggestion of a movie from DB
+func GetTagSuggestion_DB(ctx context.Context, movieId string, suggestionId string) (TagSuggestion, error) {
+	slog.DebugContext(ctx, "Inside GetTagSuggestion_DB func")
+
+	ctx, cancel := dbContext(ctx)
+	defer cancel()
+
+	var suggestion TagSuggestion
+	row := db.QueryRowContext(ctx, "SELECT suggestionId, movieId, kind, value, status, createdAt FROM movie_tag_suggestions WHERE movieId = ? AND suggestionId = ?", movieId, suggestionId)
+
+	if err := row.Scan(&suggestion.SuggestionId, &suggestion.MovieId, &suggestion.Kind, &suggestion.Value, &suggestion.Status, &suggestion.CreatedAt); err != nil {
+		if err == sql.ErrNoRows {
+			slog.DebugContext(ctx, "GetTagSuggestion_DB error", "error", err)
+			return suggestion, newError(ErrNotFound, "No tag suggestion found with given suggestionId")
+		}
+		return suggestion, fmt.Errorf("GetTagSuggestion_DB error: %v", err)
+	}
+
+	return suggestion, nil
+}
+
+// Update the status of a pending tag suggestion in DB. Returns ErrSuggestionReviewed
+// when it was already accepted or rejected, e.g. by a concurrent request.
+func UpdateTagSuggestionStatus_DB(ctx context.Context, suggestionId int, status string) error {
+	slog.DebugContext(ctx, "Inside UpdateTagSuggestionStatus_DB func")
+
+	ctx, cancel := dbContext(ctx)
+	defer cancel()
+
+	return reviewTagSuggestion(ctx, db, suggestionId, status)
+}
+
+// Move a pending suggestion to status, only one of concurrent reviews can succeed
+func reviewTagSuggestion(ctx context.Context, conn execer, suggestionId int, status string) error {
+	result, err := conn.ExecContext(ctx, "UPDATE movie_tag_suggestions SET status = ? WHERE suggestionId = ? AND status = ?", status, suggestionId, TAG_STATUS_PENDING)
+	if err != nil {
+		return fmt.Errorf("reviewTagSuggestion error: %v", err)
+	}
+
+	updated, err := result.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("reviewTagSuggestion error: %v", err)
+	}
+	if updated == 0 {
+		return ErrSuggestionReviewed
+	}
+
+	return nil
+}
+
+// Mark a suggestion as accepted and apply genres and advisory ratings to the movie in DB
+func AcceptTagSuggestion_DB(ctx context.Context, suggestion TagSuggestion) error {
+	slog.DebugContext(ctx, "Inside AcceptTagSuggestion_DB func")
+
+	ctx, cancel := dbContext(ctx)
+	defer cancel()
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("AcceptTagSuggestion_DB error: %v", err)
+	}
+	defer tx.Rollback()
+
+	// first, so the row stays locked and a concurrent accept or reject fails here
+	if err := reviewTagSuggestion(ctx, tx, suggestion.SuggestionId, TAG_STATUS_ACCEPTED); err != nil {
+		return err
+	}
+
+	switch suggestion.Kind {
+	case TAG_KIND_GENRE:
+		var genre string
+		if err := tx.QueryRowContext(ctx, "SELECT genre FROM movie_details WHERE movieId = ? FOR UPDATE", suggestion.MovieId).Scan(&genre); err != nil {
+			return fmt.Errorf("AcceptTagSuggestion_DB error: %v", err)
+		}
+
+		genre = addGenre(genre, suggestion.Value)
+		if utf8.RuneCountInString(genre) > MAX_GENRE_LENGTH {
+			return newError(ErrConflict, fmt.Sprintf("adding %q would make the genres longer than %d characters", suggestion.Value, MAX_GENRE_LENGTH))
+		}
+
+		if _, err := tx.ExecContext(ctx, "UPDATE movie_details SET genre = ? WHERE movieId = ?", genre, suggestion.MovieId); err != nil {
+			return fmt.Errorf("AcceptTagSuggestion_DB error: %v", err)
+		}
+	case TAG_KIND_ADVISORY:
+		if _, err := tx.ExecContext(ctx, "UPDATE movie_details SET contentAdvisory = ? WHERE movieId = ?", suggestion.Value, suggestion.MovieId); err != nil {
+			return fmt.Errorf("AcceptTagSuggestion_DB error: %v", err)
+		}
+
+		// only one advisory rating can apply, drop the competing ones
+		if _, err := tx.ExecContext(ctx, "UPDATE movie_tag_suggestions SET status = ? WHERE movieId = ? AND kind = ? AND status = ?", TAG_STATUS_REJECTED, suggestion.MovieId, TAG_KIND_ADVISORY, TAG_STATUS_PENDING); err != nil {
+			return fmt.Errorf("AcceptTagSuggestion_DB error: %v", err)
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("AcceptTagSuggestion_DB error: %v", err)
+	}
+
+	return nil
+}
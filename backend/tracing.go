@@ -0,0 +1,102 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"os"
+	"slices"
+
+	"github.com/AJ-Walker/movies-rest-api/config"
+	"github.com/gin-gonic/gin"
+	"go.opentelemetry.io/contrib/instrumentation/github.com/gin-gonic/gin/otelgin"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+var tracer = otel.Tracer("github.com/AJ-Walker/movies-rest-api")
+
+// nil while tracing is off
+var tracerProvider *sdktrace.TracerProvider
+
+// Set up tracing based on the tracing.exporter setting (OTEL_TRACES_EXPORTER): "none"
+// (default), "otlp" to send spans to a collector, or "stdout" for local debugging. W3C
+// trace context is always propagated, so traces of callers stay connected even when off.
+func InitTracing(ctx context.Context) error {
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+
+	tracing := appConfig.Tracing
+
+	var exporter sdktrace.SpanExporter
+	var err error
+	switch tracing.Exporter {
+	case config.TRACES_OTLP:
+		var options []otlptracehttp.Option
+		if tracing.Endpoint != "" {
+			options = append(options, otlptracehttp.WithEndpointURL(tracing.Endpoint))
+		}
+		exporter, err = otlptracehttp.New(ctx, options...)
+	case config.TRACES_STDOUT:
+		exporter, err = stdouttrace.New(stdouttrace.WithWriter(os.Stdout), stdouttrace.WithPrettyPrint())
+	default:
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	res, err := resource.Merge(resource.Default(), resource.NewWithAttributes(semconv.SchemaURL, semconv.ServiceName(tracing.ServiceName)))
+	if err != nil {
+		return err
+	}
+
+	// callers that already sample a trace decide for us, new traces are sampled by ratio
+	tracerProvider = sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(res),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(tracing.SampleRatio))),
+	)
+	otel.SetTracerProvider(tracerProvider)
+
+	slog.Info("Tracing enabled", "exporter", tracing.Exporter, "sampleRatio", tracing.SampleRatio)
+	return nil
+}
+
+// Flush buffered spans, called once on shutdown
+func shutdownTracing(ctx context.Context) {
+	if tracerProvider == nil {
+		return
+	}
+
+	if err := tracerProvider.Shutdown(ctx); err != nil {
+		slog.Warn("Error flushing spans", "error", err)
+	}
+}
+
+// Middleware starting a span per request, named after the route template. Probes and
+// scrapes aren't traced.
+func tracingMiddleware() gin.HandlerFunc {
+	return otelgin.Middleware(appConfig.Tracing.ServiceName, otelgin.WithGinFilter(func(c *gin.Context) bool {
+		return !slices.Contains(probeRoutes, c.FullPath())
+	}))
+}
+
+// Start a span for a step of our own, e.g. one model attempt. End it with endSpan.
+func startSpan(ctx context.Context, name string, options ...trace.SpanStartOption) (context.Context, trace.Span) {
+	return tracer.Start(ctx, name, options...)
+}
+
+// End a span and mark it failed when err isn't nil
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log/slog"
+	"slices"
+)
+
+// unitOfWork ties a DB transaction to the blob operations around it. Objects uploaded
+// for the transaction are deleted if it rolls back or fails to commit, objects it
+// replaces are deleted only once it has committed. Blob deletes never fail the unit,
+// anything left behind is found by the storage reconciliation.
+type unitOfWork struct {
+	ctx      context.Context
+	tx       *sql.Tx
+	uploaded []string
+	replaced []string
+	done     bool
+}
+
+// Start a unit of work, the uploaded objects are deleted if the transaction can't start.
+// The transaction rolls back if ctx is canceled before it commits.
+func beginUnitOfWork(ctx context.Context, uploaded ...string) (*unitOfWork, error) {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		deleteCoverObjects(ctx, uploaded)
+		return nil, fmt.Errorf("beginUnitOfWork error: %v", err)
+	}
+
+	return &unitOfWork{ctx: ctx, tx: tx, uploaded: uploaded}, nil
+}
+
+// Delete the objects once the transaction has committed
+func (u *unitOfWork) DeleteAfterCommit(keys ...string) {
+	u.replaced = append(u.replaced, keys...)
+}
+
+func (u *unitOfWork) Commit() error {
+	if u.done {
+		return nil
+	}
+	u.done = true
+
+	// if the commit outcome is unknown (e.g. the connection dropped) the reconciliation
+	// reports the row as a dangling reference
+	if err := u.tx.Commit(); err != nil {
+		deleteCoverObjects(u.ctx, u.uploaded)
+		return fmt.Errorf("unitOfWork commit error: %v", err)
+	}
+
+	deleteCoverObjects(u.ctx, u.replaced)
+	return nil
+}
+
+// Roll back unless already committed, safe to defer
+func (u *unitOfWork) Rollback() {
+	if u.done {
+		return
+	}
+	u.done = true
+
+	if err := u.tx.Rollback(); err != nil {
+		slog.ErrorContext(u.ctx, "unitOfWork rollback error", "error", err)
+	}
+	deleteCoverObjects(u.ctx, u.uploaded)
+}
+
+// Keys of an upload, none when no cover was uploaded
+func uploadedKeys(cover coverUpload) []string {
+	if cover.Key == "" {
+		return nil
+	}
+	return coverObjectKeys(cover.Key, cover.Variants)
+}
+
+// Insert a movie together with its already uploaded cover, if any
+func createMovie(ctx context.Context, movie Movie, cover coverUpload) (int, error) {
+	slog.DebugContext(ctx, "Inside createMovie func")
+
+	uow, err := beginUnitOfWork(ctx, uploadedKeys(cover)...)
+	if err != nil {
+		return 0, err
+	}
+	defer uow.Rollback()
+
+	if cover.Key != "" {
+		movie.CoverKey = &cover.Key
+		movie.CoverVariantKeys = cover.Variants
+	}
+
+	movieId, err := AddMovie_DB(ctx, uow.tx, movie)
+	if err != nil {
+		return 0, err
+	}
+
+	if err := uow.Commit(); err != nil {
+		return 0, err
+	}
+
+	return movieId, nil
+}
+
+// Update a movie, replacing its cover when a new one was uploaded
+func saveMovie(ctx context.Context, movieId int, movie Movie, cover coverUpload) error {
+	slog.DebugContext(ctx, "Inside saveMovie func")
+
+	uow, err := beginUnitOfWork(ctx, uploadedKeys(cover)...)
+	if err != nil {
+		return err
+	}
+	defer uow.Rollback()
+
+	previous, err := GetMovieObjectKeys_DB(ctx, uow.tx, movieId, false)
+	if err != nil {
+		return err
+	}
+
+	if cover.Key != "" {
+		movie.CoverKey = &cover.Key
+		movie.CoverVariantKeys = cover.Variants
+		uow.DeleteAfterCommit(previous...)
+	}
+
+	if err := UpdateMovieById_DB(ctx, uow.tx, movieId, movie); err != nil {
+		return err
+	}
+
+	return uow.Commit()
+}
+
+// Point a movie to a newly uploaded cover, the previous cover is deleted after commit
+func replaceCover(ctx context.Context, movieId int, cover coverUpload) error {
+	slog.DebugContext(ctx, "Inside replaceCover func")
+
+	uploaded := uploadedKeys(cover)
+	uow, err := beginUnitOfWork(ctx, uploaded...)
+	if err != nil {
+		return err
+	}
+	defer uow.Rollback()
+
+	previous, err := GetMovieObjectKeys_DB(ctx, uow.tx, movieId, false)
+	if err != nil {
+		return err
+	}
+	// never the objects being attached, even if the movie already points to them
+	previous = slices.DeleteFunc(previous, func(key string) bool { return slices.Contains(uploaded, key) })
+	uow.DeleteAfterCommit(previous...)
+
+	if err := UpdateMovieCover_DB(ctx, uow.tx, movieId, cover); err != nil {
+		return err
+	}
+
+	return uow.Commit()
+}
+
+// Remove a movie's cover, the objects are deleted after commit
+func removeCover(ctx context.Context, movieId int) error {
+	slog.DebugContext(ctx, "Inside removeCover func")
+
+	uow, err := beginUnitOfWork(ctx)
+	if err != nil {
+		return err
+	}
+	defer uow.Rollback()
+
+	previous, err := GetMovieObjectKeys_DB(ctx, uow.tx, movieId, false)
+	if err != nil {
+		return err
+	}
+	uow.DeleteAfterCommit(previous...)
+
+	if err := ClearMovieCover_DB(ctx, uow.tx, movieId); err != nil {
+		return err
+	}
+
+	return uow.Commit()
+}
+
+// Delete a movie, its cover and gallery objects are deleted after commit
+func removeMovie(ctx context.Context, movieId int) error {
+	slog.DebugContext(ctx, "Inside removeMovie func")
+
+	uow, err := beginUnitOfWork(ctx)
+	if err != nil {
+		return err
+	}
+	defer uow.Rollback()
+
+	previous, err := GetMovieObjectKeys_DB(ctx, uow.tx, movieId, true)
+	if err != nil {
+		return err
+	}
+	uow.DeleteAfterCommit(previous...)
+
+	if err := DeleteMovieById_DB(ctx, uow.tx, movieId); err != nil {
+		return err
+	}
+
+	return uow.Commit()
+}
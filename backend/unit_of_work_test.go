@@ -0,0 +1,410 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"io"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/go-sql-driver/mysql"
+)
+
+// Failure injection for the unit of work. An in-process SQL driver and a blob store wrapper
+// fail on demand, so the tests need neither MySQL nor S3.
+
+var errInjected = errors.New("injected failure")
+
+// what MySQL returns when an insert or update violates the unique title and release year index
+var duplicateEntry = &mysql.MySQLError{Number: MYSQL_DUPLICATE_ENTRY, Message: "Duplicate entry 'check-2000' for key 'movie_details.uq_movie_details_title_year'"}
+
+// faultBlobStore wraps a BlobStore and fails puts after a number of successful ones, or every delete
+type faultBlobStore struct {
+	BlobStore
+	putsBeforeFailure int // negative never fails
+	failDeletes       bool
+	puts              int
+}
+
+func (s *faultBlobStore) Put(ctx context.Context, key string, body io.Reader, size int64, contentType string) error {
+	if s.putsBeforeFailure >= 0 && s.puts >= s.putsBeforeFailure {
+		return errInjected
+	}
+	s.puts++
+	return s.BlobStore.Put(ctx, key, body, size, contentType)
+}
+
+func (s *faultBlobStore) Delete(ctx context.Context, key string) error {
+	if s.failDeletes {
+		return errInjected
+	}
+	return s.BlobStore.Delete(ctx, key)
+}
+
+// faultSQL is the state behind the "faultsql" driver. Statements are matched by prefix.
+type faultSQL struct {
+	mu         sync.Mutex
+	failExec   map[string]error
+	rows       map[string][][]driver.Value
+	failCommit error
+}
+
+func (s *faultSQL) reset() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.failExec = map[string]error{}
+	s.rows = map[string][][]driver.Value{}
+	s.failCommit = nil
+}
+
+// Value of the first prefix the query starts with
+func matchPrefix[V any](query string, values map[string]V) (V, bool) {
+	for prefix, value := range values {
+		if strings.HasPrefix(query, prefix) {
+			return value, true
+		}
+	}
+
+	var zero V
+	return zero, false
+}
+
+type faultDriver struct{ state *faultSQL }
+type faultConn struct{ state *faultSQL }
+type faultStmt struct {
+	state *faultSQL
+	query string
+}
+type faultTx struct{ state *faultSQL }
+type faultResult struct{}
+type faultRows struct {
+	values [][]driver.Value
+	next   int
+}
+
+func (d faultDriver) Open(name string) (driver.Conn, error) { return &faultConn{state: d.state}, nil }
+
+func (c *faultConn) Prepare(query string) (driver.Stmt, error) {
+	return &faultStmt{state: c.state, query: query}, nil
+}
+func (c *faultConn) Close() error              { return nil }
+func (c *faultConn) Begin() (driver.Tx, error) { return &faultTx{state: c.state}, nil }
+
+func (s *faultStmt) Close() error  { return nil }
+func (s *faultStmt) NumInput() int { return -1 }
+
+func (s *faultStmt) Exec(args []driver.Value) (driver.Result, error) {
+	s.state.mu.Lock()
+	defer s.state.mu.Unlock()
+
+	if err, ok := matchPrefix(s.query, s.state.failExec); ok {
+		return nil, err
+	}
+	return faultResult{}, nil
+}
+
+func (s *faultStmt) Query(args []driver.Value) (driver.Rows, error) {
+	s.state.mu.Lock()
+	defer s.state.mu.Unlock()
+
+	if err, ok := matchPrefix(s.query, s.state.failExec); ok {
+		return nil, err
+	}
+	if values, ok := matchPrefix(s.query, s.state.rows); ok {
+		return &faultRows{values: values}, nil
+	}
+	return &faultRows{}, nil
+}
+
+func (t *faultTx) Commit() error {
+	t.state.mu.Lock()
+	defer t.state.mu.Unlock()
+	return t.state.failCommit
+}
+func (t *faultTx) Rollback() error { return nil }
+
+func (r faultResult) LastInsertId() (int64, error) { return 1, nil }
+func (r faultResult) RowsAffected() (int64, error) { return 1, nil }
+
+func (r *faultRows) Columns() []string {
+	if len(r.values) == 0 {
+		return nil
+	}
+	columns := make([]string, len(r.values[0]))
+	for i := range columns {
+		columns[i] = fmt.Sprintf("column%d", i)
+	}
+	return columns
+}
+func (r *faultRows) Close() error { return nil }
+func (r *faultRows) Next(dest []driver.Value) error {
+	if r.next >= len(r.values) {
+		return io.EOF
+	}
+	copy(dest, r.values[r.next])
+	r.next++
+	return nil
+}
+
+var (
+	registerFaultDriver sync.Once
+	faultState          = &faultSQL{}
+)
+
+// Point db at the fault injection driver for the rest of the test, with a fresh state
+func useFaultDB(t *testing.T) *faultSQL {
+	t.Helper()
+	registerFaultDriver.Do(func() { sql.Register("faultsql", faultDriver{state: faultState}) })
+	faultState.reset()
+
+	previous := db
+	t.Cleanup(func() { db = previous })
+
+	var err error
+	if db, err = sql.Open("faultsql", ""); err != nil {
+		t.Fatalf("cannot open fault injection driver: %v", err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	return faultState
+}
+
+// A valid PNG cover for the tests
+func checkCoverImage() []byte {
+	img := image.NewRGBA(image.Rect(0, 0, 300, 450))
+	for y := 0; y < 450; y++ {
+		for x := 0; x < 300; x++ {
+			img.Set(x, y, color.RGBA{uint8(x), uint8(y), 120, 255})
+		}
+	}
+
+	var buf bytes.Buffer
+	png.Encode(&buf, img)
+	return buf.Bytes()
+}
+
+func TestUnitOfWork(t *testing.T) {
+	state := useFaultDB(t)
+
+	previousBlobs := Blobs
+	t.Cleanup(func() { Blobs = previousBlobs })
+
+	dir := t.TempDir()
+	local, err := newLocalBlobStore(dir, "http://localhost/files")
+	if err != nil {
+		t.Fatalf("cannot create blob store: %v", err)
+	}
+
+	store := &faultBlobStore{BlobStore: local, putsBeforeFailure: -1}
+	Blobs = store
+
+	ctx := context.Background()
+	data := checkCoverImage()
+	movie := Movie{Title: "Check", ReleaseYear: 2000, Genre: "Drama"}
+
+	// all of the expected keys must be stored and nothing else
+	expectStored := func(t *testing.T, expected []string) {
+		t.Helper()
+		objects, _ := local.List(ctx, "")
+		stored := []string{}
+		for _, object := range objects {
+			stored = append(stored, object.Key)
+		}
+		sort.Strings(stored)
+
+		expected = append([]string{}, expected...)
+		sort.Strings(expected)
+		if strings.Join(stored, ",") != strings.Join(expected, ",") {
+			t.Errorf("stored objects %v, expected %v", stored, expected)
+		}
+	}
+
+	// fresh DB and store state for every scenario
+	scenario := func(name string, run func(t *testing.T)) {
+		t.Run(name, func(t *testing.T) {
+			state.reset()
+			store.putsBeforeFailure, store.failDeletes, store.puts = -1, false, 0
+			os.RemoveAll(dir)
+			os.MkdirAll(dir, 0o755)
+			run(t)
+		})
+	}
+
+	upload := func(t *testing.T, coverName string) coverUpload {
+		t.Helper()
+		cover, err := storeCoverImage(ctx, data, coverName)
+		if err != nil {
+			t.Fatalf("upload failed: %v", err)
+		}
+		return cover
+	}
+
+	// an existing movie with a stored cover, as returned by the locking select
+	existingCover := func(t *testing.T) coverUpload {
+		t.Helper()
+		cover := upload(t, "old")
+		variants, _ := json.Marshal(cover.Variants)
+		state.rows["SELECT coverKey, coverVariants"] = [][]driver.Value{{cover.Key, string(variants)}}
+		return cover
+	}
+
+	scenario("create commits", func(t *testing.T) {
+		cover := upload(t, "new")
+		if _, err := createMovie(ctx, movie, cover); err != nil {
+			t.Errorf("unexpected error %v", err)
+		}
+		expectStored(t, uploadedKeys(cover))
+	})
+
+	scenario("create insert fails", func(t *testing.T) {
+		cover := upload(t, "new")
+		state.failExec["INSERT INTO movie_details"] = errInjected
+		if _, err := createMovie(ctx, movie, cover); err == nil {
+			t.Error("expected an error")
+		}
+		expectStored(t, nil)
+	})
+
+	scenario("create commit fails", func(t *testing.T) {
+		cover := upload(t, "new")
+		state.failCommit = errInjected
+		if _, err := createMovie(ctx, movie, cover); err == nil {
+			t.Error("expected an error")
+		}
+		expectStored(t, nil)
+	})
+
+	scenario("create duplicate title and year", func(t *testing.T) {
+		cover := upload(t, "new")
+		state.failExec["INSERT INTO movie_details"] = duplicateEntry
+		state.rows["SELECT movieId FROM movie_details WHERE normalizedTitle"] = [][]driver.Value{{int64(2)}}
+		if _, err := createMovie(ctx, movie, cover); !errors.Is(err, ErrDuplicateMovie) {
+			t.Errorf("expected ErrDuplicateMovie, got %v", err)
+		} else if problem := problemFor(err); problem.Status != http.StatusConflict || problem.Existing != "/api/movies/2" {
+			t.Errorf("expected a 409 referencing movie 2, got %v %q", problem.Status, problem.Existing)
+		}
+		expectStored(t, nil)
+	})
+
+	scenario("create duplicate on another key is not a duplicate movie", func(t *testing.T) {
+		cover := upload(t, "new")
+		state.failExec["INSERT INTO movie_details"] = &mysql.MySQLError{Number: MYSQL_DUPLICATE_ENTRY, Message: "Duplicate entry '1' for key 'movie_details.PRIMARY'"}
+		if _, err := createMovie(ctx, movie, cover); err == nil || errors.Is(err, ErrDuplicateMovie) {
+			t.Errorf("expected a plain DB error, got %v", err)
+		}
+		expectStored(t, nil)
+	})
+
+	scenario("update duplicate title and year keeps previous cover", func(t *testing.T) {
+		previous := existingCover(t)
+		cover := upload(t, "new")
+		state.failExec["UPDATE movie_details SET title"] = duplicateEntry
+		if err := saveMovie(ctx, 1, movie, cover); !errors.Is(err, ErrDuplicateMovie) {
+			t.Errorf("expected ErrDuplicateMovie, got %v", err)
+		}
+		expectStored(t, uploadedKeys(previous))
+	})
+
+	scenario("update replaces cover after commit", func(t *testing.T) {
+		existingCover(t)
+		cover := upload(t, "new")
+		if err := saveMovie(ctx, 1, movie, cover); err != nil {
+			t.Errorf("unexpected error %v", err)
+		}
+		expectStored(t, uploadedKeys(cover))
+	})
+
+	scenario("update fails keeps previous cover", func(t *testing.T) {
+		previous := existingCover(t)
+		cover := upload(t, "new")
+		state.failExec["UPDATE movie_details"] = errInjected
+		if err := saveMovie(ctx, 1, movie, cover); err == nil {
+			t.Error("expected an error")
+		}
+		expectStored(t, uploadedKeys(previous))
+	})
+
+	scenario("update commit fails keeps previous cover", func(t *testing.T) {
+		previous := existingCover(t)
+		cover := upload(t, "new")
+		state.failCommit = errInjected
+		if err := saveMovie(ctx, 1, movie, cover); err == nil {
+			t.Error("expected an error")
+		}
+		expectStored(t, uploadedKeys(previous))
+	})
+
+	scenario("update without cover keeps cover", func(t *testing.T) {
+		previous := existingCover(t)
+		if err := saveMovie(ctx, 1, movie, coverUpload{}); err != nil {
+			t.Errorf("unexpected error %v", err)
+		}
+		expectStored(t, uploadedKeys(previous))
+	})
+
+	scenario("replace cover with the current cover keeps it", func(t *testing.T) {
+		current := existingCover(t)
+		if err := replaceCover(ctx, 1, current); err != nil {
+			t.Errorf("unexpected error %v", err)
+		}
+		expectStored(t, uploadedKeys(current))
+	})
+
+	scenario("replace cover fails keeps previous cover", func(t *testing.T) {
+		previous := existingCover(t)
+		cover := upload(t, "new")
+		state.failExec["UPDATE movie_details SET coverKey"] = errInjected
+		if err := replaceCover(ctx, 1, cover); err == nil {
+			t.Error("expected an error")
+		}
+		expectStored(t, uploadedKeys(previous))
+	})
+
+	scenario("delete movie removes objects after commit", func(t *testing.T) {
+		existingCover(t)
+		if err := removeMovie(ctx, 1); err != nil {
+			t.Errorf("unexpected error %v", err)
+		}
+		expectStored(t, nil)
+	})
+
+	scenario("delete movie fails keeps objects", func(t *testing.T) {
+		previous := existingCover(t)
+		state.failExec["DELETE FROM movie_details"] = errInjected
+		if err := removeMovie(ctx, 1); err == nil {
+			t.Error("expected an error")
+		}
+		expectStored(t, uploadedKeys(previous))
+	})
+
+	scenario("blob delete failure after commit is not an error", func(t *testing.T) {
+		previous := existingCover(t)
+		store.failDeletes = true
+		if err := removeCover(ctx, 1); err != nil {
+			t.Errorf("unexpected error %v", err)
+		}
+		// left for the storage reconciliation
+		expectStored(t, uploadedKeys(previous))
+	})
+
+	scenario("partial upload is cleaned up", func(t *testing.T) {
+		store.putsBeforeFailure = 3
+		if _, err := storeCoverImage(ctx, data, "new"); err == nil {
+			t.Error("expected an error")
+		}
+		expectStored(t, nil)
+	})
+}
@@ -0,0 +1,308 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	LLM_OP_SUMMARY  string = "summary"
+	LLM_OP_CHAT     string = "chat"
+	LLM_OP_TAGGING  string = "tagging"
+	LLM_OP_ALT_TEXT string = "alt-text"
+)
+
+var ErrBudgetExhausted = newError(ErrUnavailable, "generation is paused because the monthly LLM budget is exhausted")
+
+type LLMUsageReportRow struct {
+	Key           string  `json:"key"`
+	Calls         int     `json:"calls"`
+	FailedCalls   int     `json:"failedCalls"`
+	InputTokens   int     `json:"inputTokens"`
+	OutputTokens  int     `json:"outputTokens"`
+	EstimatedCost float64 `json:"estimatedCost"`
+	AvgLatencyMs  float64 `json:"avgLatencyMs"`
+}
+
+// usageTrackingGenerator records every model call in the llm_usage table and refuses
+// new calls once the monthly budget is spent
+type usageTrackingGenerator struct {
+	next SummaryGenerator
+}
+
+func (g usageTrackingGenerator) Generate(ctx context.Context, req GenerationRequest) (result GenerationResult, err error) {
+	ctx, span := startSpan(ctx, "llm."+req.Operation)
+	defer func() { endSpan(span, err) }()
+
+	if llmBudgetExhausted(ctx) {
+		return GenerationResult{}, ErrBudgetExhausted
+	}
+
+	start := time.Now()
+	result, err = g.next.Generate(ctx, req)
+	recordLLMUsage(ctx, req, result, time.Since(start), err)
+
+	return result, err
+}
+
+func (g usageTrackingGenerator) GenerateStream(ctx context.Context, req GenerationRequest, onDelta func(string) error) (result GenerationResult, err error) {
+	ctx, span := startSpan(ctx, "llm."+req.Operation)
+	defer func() { endSpan(span, err) }()
+
+	if llmBudgetExhausted(ctx) {
+		return GenerationResult{}, ErrBudgetExhausted
+	}
+
+	start := time.Now()
+	result, err = g.next.GenerateStream(ctx, req, onDelta)
+	recordLLMUsage(ctx, req, result, time.Since(start), err)
+
+	return result, err
+}
+
+// Not usable once the budget is spent, otherwise as healthy as the generator behind it
+func (g usageTrackingGenerator) Check(ctx context.Context) error {
+	if llmBudgetExhausted(ctx) {
+		return ErrBudgetExhausted
+	}
+	if checker, ok := g.next.(healthChecker); ok {
+		return checker.Check(ctx)
+	}
+	return nil
+}
+
+func recordLLMUsage(ctx context.Context, req GenerationRequest, result GenerationResult, latency time.Duration, err error) {
+	modelId := result.ModelId
+	if modelId == "" {
+		modelId = appConfig.LLM.ModelId
+	}
+
+	metrics.observeLLMCall(req.Operation, modelId, result.InputTokens, result.OutputTokens, latency, err)
+	cost := estimateCost(modelId, result.InputTokens, result.OutputTokens)
+
+	// tokens are billed even when the caller went away, so the usage is always recorded
+	if err := AddLLMUsage_DB(context.WithoutCancel(ctx), req.Operation, modelId, req.UserId, result.InputTokens, result.OutputTokens, latency, cost, err == nil); err != nil {
+		slog.ErrorContext(ctx, "Error recording LLM usage", "operation", req.Operation, "error", err)
+		return
+	}
+
+	budget.add(cost)
+}
+
+// The user a model call is billed to, taken from the X-User-Id header
+func llmUser(c *gin.Context) string {
+	if userId := c.GetHeader("X-User-Id"); userId != "" {
+		return userId
+	}
+	return "anonymous"
+}
+
+// Month to date spend, cached so not every model call has to sum the usage table
+type budgetTracker struct {
+	mu         sync.Mutex
+	month      time.Time // first day of the cached month in UTC
+	spent      float64
+	checkedAt  time.Time
+	refreshing bool
+}
+
+var budget budgetTracker
+
+const BUDGET_REFRESH_INTERVAL = time.Minute
+
+// First day of the month the time falls in, in UTC like the stored usage
+func monthStart(t time.Time) time.Time {
+	t = t.UTC()
+	return time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, time.UTC)
+}
+
+func (b *budgetTracker) monthToDate(ctx context.Context) (float64, error) {
+	now := time.Now()
+	month := monthStart(now)
+
+	// the query runs outside the lock, while one caller refreshes the others get the
+	// cached value of the same month
+	b.mu.Lock()
+	if b.month.Equal(month) && (b.refreshing || now.Sub(b.checkedAt) < BUDGET_REFRESH_INTERVAL) {
+		spent := b.spent
+		b.mu.Unlock()
+		return spent, nil
+	}
+	refresh := !b.refreshing
+	b.refreshing = true
+	b.mu.Unlock()
+
+	spent, err := GetMonthToDateLLMCost_DB(ctx)
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if refresh {
+		b.refreshing = false
+	}
+	if err != nil {
+		if b.month.Equal(month) {
+			return b.spent, err
+		}
+		return 0, err
+	}
+
+	b.month, b.spent, b.checkedAt = month, spent, now
+	return spent, nil
+}
+
+func (b *budgetTracker) add(cost float64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.spent += cost
+}
+
+// Monthly budget in USD from the llm.monthlyBudgetUsd setting, 0 means no limit
+func llmMonthlyBudget() float64 {
+	return appConfig.LLM.MonthlyBudgetUSD
+}
+
+func llmBudgetExhausted(ctx context.Context) bool {
+	limit := llmMonthlyBudget()
+	if limit <= 0 {
+		return false
+	}
+
+	spent, err := budget.monthToDate(ctx)
+	if err != nil {
+		// don't block model calls because the usage table can't be read
+		slog.ErrorContext(ctx, "Error reading LLM spend, not enforcing the budget", "error", err)
+		return false
+	}
+
+	return spent >= limit
+}
+
+// Handler for GET /api/admin/llm-usage
+func getLLMUsage(c *gin.Context) {
+	slog.DebugContext(c.Request.Context(), "Inside getLLMUsage func")
+
+	groupBy := c.DefaultQuery("groupBy", "day")
+	from := c.DefaultQuery("from", time.Now().AddDate(0, 0, -30).Format(time.DateOnly))
+	to := c.DefaultQuery("to", time.Now().Format(time.DateOnly))
+
+	slog.DebugContext(c.Request.Context(), "Query", "groupBy", groupBy, "from", from, "to", to)
+
+	fromDate, err := time.Parse(time.DateOnly, from)
+	if err != nil {
+		respondError(c, invalidField("from", "must be a date in YYYY-MM-DD format"))
+		return
+	}
+
+	toDate, err := time.Parse(time.DateOnly, to)
+	if err != nil {
+		respondError(c, invalidField("to", "must be a date in YYYY-MM-DD format"))
+		return
+	}
+
+	rows, err := GetLLMUsageReport_DB(c.Request.Context(), groupBy, fromDate, toDate.AddDate(0, 0, 1))
+	if err != nil {
+		respondError(c, err)
+		return
+	}
+
+	spent, err := budget.monthToDate(c.Request.Context())
+	if err != nil {
+		slog.ErrorContext(c.Request.Context(), "Error reading LLM spend", "error", err)
+	}
+
+	data := gin.H{
+		"groupBy": groupBy,
+		"from":    from,
+		"to":      to,
+		"rows":    rows,
+		"budget": gin.H{
+			"monthlyBudget":   llmMonthlyBudget(),
+			"monthToDateCost": spent,
+			"cachedOnly":      llmBudgetExhausted(c.Request.Context()),
+		},
+	}
+
+	c.JSON(http.StatusOK, response(http.StatusOK, true, "LLM usage fetched", data))
+}
+
+// Save a model call in DB
+func AddLLMUsage_DB(ctx context.Context, operation string, modelId string, userId string, inputTokens int, outputTokens int, latency time.Duration, cost float64, success bool) error {
+	ctx, cancel := dbContext(ctx)
+	defer cancel()
+
+	_, err := db.ExecContext(ctx, "INSERT INTO llm_usage (operation, modelId, userId, inputTokens, outputTokens, latencyMs, estimatedCost, success) VALUES (?,?,?,?,?,?,?,?)",
+		operation, modelId, userId, inputTokens, outputTokens, latency.Milliseconds(), cost, success)
+	if err != nil {
+		return fmt.Errorf("AddLLMUsage_DB error: %v", err)
+	}
+
+	return nil
+}
+
+// Get the estimated cost of all model calls in the current month from DB
+func GetMonthToDateLLMCost_DB(ctx context.Context) (float64, error) {
+	slog.DebugContext(ctx, "Inside GetMonthToDateLLMCost_DB func")
+
+	ctx, cancel := dbContext(ctx)
+	defer cancel()
+
+	var cost float64
+	if err := db.QueryRowContext(ctx, "SELECT COALESCE(SUM(estimatedCost), 0) FROM llm_usage WHERE createdAt >= ?", monthStart(time.Now())).Scan(&cost); err != nil {
+		return 0, fmt.Errorf("GetMonthToDateLLMCost_DB error: %v", err)
+	}
+
+	return cost, nil
+}
+
+// Get the model usage aggregated per day, model or user between two dates from DB
+func GetLLMUsageReport_DB(ctx context.Context, groupBy string, from time.Time, to time.Time) ([]LLMUsageReportRow, error) {
+	slog.DebugContext(ctx, "Inside GetLLMUsageReport_DB func")
+
+	ctx, cancel := dbContext(ctx)
+	defer cancel()
+
+	groupColumns := map[string]string{
+		"day":   "DATE_FORMAT(createdAt, '%Y-%m-%d')",
+		"model": "modelId",
+		"user":  "userId",
+	}
+
+	column, ok := groupColumns[groupBy]
+	if !ok {
+		return nil, invalidField("groupBy", "must be one of day, model or user")
+	}
+
+	query := fmt.Sprintf(`SELECT %v AS groupKey, COUNT(*), SUM(NOT success), SUM(inputTokens), SUM(outputTokens), SUM(estimatedCost), AVG(latencyMs)
+		FROM llm_usage WHERE createdAt >= ? AND createdAt < ? GROUP BY groupKey ORDER BY groupKey`, column)
+
+	rows, err := db.QueryContext(ctx, query, from, to)
+	if err != nil {
+		return nil, fmt.Errorf("GetLLMUsageReport_DB error: %v", err)
+	}
+
+	defer rows.Close()
+
+	report := []LLMUsageReportRow{}
+	for rows.Next() {
+		var row LLMUsageReportRow
+
+		if err := rows.Scan(&row.Key, &row.Calls, &row.FailedCalls, &row.InputTokens, &row.OutputTokens, &row.EstimatedCost, &row.AvgLatencyMs); err != nil {
+			return nil, fmt.Errorf("GetLLMUsageReport_DB error: %v", err)
+		}
+
+		report = append(report, row)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("GetLLMUsageReport_DB error: %v", err)
+	}
+
+	return report, nil
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"context"
+	"database/sql/driver"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestBudgetMonthToDate(t *testing.T) {
+	state := useFaultDB(t)
+	state.rows["SELECT COALESCE(SUM(estimatedCost), 0) FROM llm_usage"] = [][]driver.Value{{float64(5)}}
+
+	now := time.Now()
+	month := monthStart(now)
+
+	tests := []struct {
+		name      string
+		tracker   *budgetTracker
+		failQuery bool
+		spent     float64
+		err       bool
+	}{
+		{"fresh cache", &budgetTracker{month: month, spent: 2, checkedAt: now}, false, 2, false},
+		{"stale cache", &budgetTracker{month: month, spent: 2, checkedAt: now.Add(-2 * BUDGET_REFRESH_INTERVAL)}, false, 5, false},
+		{"same month a year ago", &budgetTracker{month: month.AddDate(-1, 0, 0), spent: 2, checkedAt: now}, false, 5, false},
+		{"refresh in progress", &budgetTracker{month: month, spent: 2, refreshing: true}, false, 2, false},
+		{"failed refresh keeps the month", &budgetTracker{month: month, spent: 2}, true, 2, true},
+		{"failed refresh of a new month", &budgetTracker{month: month.AddDate(0, -1, 0), spent: 2, checkedAt: now}, true, 0, true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			delete(state.failExec, "SELECT COALESCE")
+			if test.failQuery {
+				state.failExec["SELECT COALESCE"] = errors.New("connection refused")
+			}
+
+			refreshing := test.tracker.refreshing
+			spent, err := test.tracker.monthToDate(context.Background())
+
+			if spent != test.spent {
+				t.Errorf("expected %v spent, got %v", test.spent, spent)
+			}
+			if (err != nil) != test.err {
+				t.Errorf("unexpected error %v", err)
+			}
+			// only the caller that started a refresh ends it
+			if test.tracker.refreshing != refreshing {
+				t.Errorf("expected refreshing %v after the call, got %v", refreshing, test.tracker.refreshing)
+			}
+		})
+	}
+}
@@ -1,7 +1,7 @@
 package main
 
 import (
-	"log"
+	"log/slog"
 
 	"github.com/gin-gonic/gin"
 	"github.com/google/uuid"
@@ -14,7 +14,7 @@ func response(statusCode int, status bool, message string, data any) gin.H {
 func generateUUID() (string, error) {
 	id, err := uuid.NewV7()
 	if err != nil {
-		log.Printf("Error generating uuid: %v", err)
+		slog.Error("Error generating uuid", "error", err)
 		return "", err
 	}
 
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Year of the oldest surviving film, nothing can be released before it
+const FIRST_FILM_YEAR int = 1888
+
+// A rule checks a sanitized field value and returns why it is invalid, or "" when it is
+// valid. The raw value is for rules that look for what sanitizing removes.
+type rule func(value string, raw string) string
+
+// Rules of a field, checked in order until one fails
+type fieldRules struct {
+	field string
+	rules []rule
+}
+
+// Rules of a movie, the same for form fields, JSON bodies and import files
+var movieRules = []fieldRules{
+	{"title", []rule{required, maxLength(MAX_TITLE_LENGTH), noInstructions}},
+	{"releaseYear", []rule{required, yearBetween(FIRST_FILM_YEAR, 1)}},
+	{"genre", []rule{required, maxLength(MAX_GENRE_LENGTH), noInstructions, genresFrom(GENRE_VOCABULARY)}},
+}
+
+func required(value string, _ string) string {
+	if value == "" {
+		return "cannot be empty"
+	}
+	return ""
+}
+
+// At most max characters, not bytes, like the VARCHAR columns
+func maxLength(max int) rule {
+	return func(value string, _ string) string {
+		if utf8.RuneCountInString(value) > max {
+			return fmt.Sprintf("cannot be longer than %d characters", max)
+		}
+		return ""
+	}
+}
+
+// A year from first up to yearsAhead years from now, so announced movies can be added
+func yearBetween(first int, yearsAhead int) rule {
+	return func(value string, _ string) string {
+		year, err := strconv.Atoi(value)
+		if err != nil {
+			return "must be a number"
+		}
+
+		last := time.Now().Year() + yearsAhead
+		if year < first || year > last {
+			return fmt.Sprintf("must be between %d and %d", first, last)
+		}
+		return ""
+	}
+}
+
+// A comma separated list of genres from the vocabulary, e.g. "Crime, Drama". Genres
+// stored before the vocabulary are mapped by migration 005_genre_vocabulary, any that
+// are left have to be replaced when the movie is next updated.
+func genresFrom(vocabulary []string) rule {
+	return func(value string, _ string) string {
+		for _, genre := range strings.Split(value, ",") {
+			genre = strings.TrimSpace(genre)
+			if genre == "" {
+				return "must be a comma separated list of genres"
+			}
+			if _, ok := canonicalGenre(vocabulary, genre); !ok {
+				return fmt.Sprintf("%q is not a known genre, allowed genres are %v", genre, strings.Join(vocabulary, ", "))
+			}
+		}
+		return ""
+	}
+}
+
+// Free text must not look like instructions to the model. The raw value is checked as
+// well, invisible characters can both hide and split patterns.
+func noInstructions(value string, raw string) string {
+	if matches := append(detectPromptInjection(raw), detectPromptInjection(value)...); len(matches) > 0 {
+		return fmt.Sprintf("contains text that looks like instructions: %q", matches[0])
+	}
+	return ""
+}
+
+// Spelling of a genre in the vocabulary, matched case-insensitively
+func canonicalGenre(vocabulary []string, genre string) (string, bool) {
+	index := slices.IndexFunc(vocabulary, func(v string) bool { return strings.EqualFold(v, strings.TrimSpace(genre)) })
+	if index == -1 {
+		return "", false
+	}
+	return vocabulary[index], true
+}
+
+// Sanitize the values and check them against the rules of every field. Returns the
+// sanitized values, or a validation error listing every invalid field at once.
+func validateFields(raw map[string]string, fields []fieldRules) (map[string]string, error) {
+	values := map[string]string{}
+	var violations []FieldError
+
+	for _, field := range fields {
+		value := sanitizeField(raw[field.field])
+		values[field.field] = value
+
+		for _, check := range field.rules {
+			if message := check(value, raw[field.field]); message != "" {
+				violations = append(violations, FieldError{Field: field.field, Message: message})
+				break
+			}
+		}
+	}
+
+	if len(violations) == 1 {
+		return values, invalidField(violations[0].Field, violations[0].Message)
+	}
+	if len(violations) > 1 {
+		return values, validationError(fmt.Sprintf("%d fields are invalid", len(violations)), violations...)
+	}
+	return values, nil
+}
+
+// MovieInput is a movie as clients send it, as form fields, a JSON body or an entry of
+// an import file
+type MovieInput struct {
+	Title       string    `json:"title" form:"title"`
+	ReleaseYear yearInput `json:"releaseYear" form:"releaseYear"`
+	Genre       string    `json:"genre" form:"genre"`
+}
+
+// yearInput takes the year as a JSON number or string, so a bad value is reported by the
+// releaseYear rules instead of failing the whole body
+type yearInput string
+
+func (y *yearInput) UnmarshalJSON(data []byte) error {
+	var value string
+	// a number, or anything else that isn't a string, is kept as written
+	if err := json.Unmarshal(data, &value); err != nil {
+		value = string(data)
+	}
+
+	*y = yearInput(value)
+	return nil
+}
+
+// Validate the input against movieRules and return the movie it describes, with
+// sanitized text and genres spelled as in the vocabulary
+func (input MovieInput) Validate() (Movie, error) {
+	values, err := validateFields(map[string]string{
+		"title":       input.Title,
+		"releaseYear": string(input.ReleaseYear),
+		"genre":       input.Genre,
+	}, movieRules)
+	if err != nil {
+		return Movie{}, err
+	}
+
+	// checked by the rules, always in range of uint16
+	year, _ := strconv.Atoi(values["releaseYear"])
+
+	var genres []string
+	for _, genre := range strings.Split(values["genre"], ",") {
+		if canonical, _ := canonicalGenre(GENRE_VOCABULARY, genre); !slices.Contains(genres, canonical) {
+			genres = append(genres, canonical)
+		}
+	}
+
+	// the stored list has a space after every comma, so it can outgrow the raw value
+	genre := strings.Join(genres, ", ")
+	if utf8.RuneCountInString(genre) > MAX_GENRE_LENGTH {
+		return Movie{}, invalidField("genre", fmt.Sprintf("cannot be longer than %d characters", MAX_GENRE_LENGTH))
+	}
+
+	return Movie{Title: values["title"], ReleaseYear: uint16(year), Genre: genre}, nil
+}
+
+// Bind a movie from the form fields or the JSON body of a request and validate it
+func bindMovie(c *gin.Context) (Movie, error) {
+	var input MovieInput
+	if err := c.ShouldBind(&input); err != nil {
+		return Movie{}, wrapError(ErrValidation, "request body is not a valid movie", err)
+	}
+
+	slog.DebugContext(c.Request.Context(), "Movie input", "title", input.Title, "releaseYear", input.ReleaseYear, "genre", input.Genre)
+
+	movie, err := input.Validate()
+	if err != nil {
+		slog.WarnContext(c.Request.Context(), "Rejected movie fields", "error", err)
+	}
+	return movie, err
+}